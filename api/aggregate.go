@@ -0,0 +1,268 @@
+package api
+
+import (
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"math"
+	"net/http"
+	"time"
+)
+
+// aggregateBucket describes one of the bucket sizes /api/aggregate supports.
+type aggregateBucket struct {
+	// start returns the beginning of the bucket containing t, which is already in the station's timezone.
+	start func(t time.Time) time.Time
+	// next returns the beginning of the bucket after the one starting at t.
+	next func(t time.Time) time.Time
+	// Longest range that may be requested with this bucket size.
+	maxSpan time.Duration
+}
+
+// Buckets are aligned on the station's wall clock rather than on UTC, so a "day" runs from local
+// midnight to local midnight (and is 23 or 25 hours long across a DST change).
+var aggregateBuckets = map[string]aggregateBucket{
+	"1h": {
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		},
+		next: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		},
+		maxSpan: 31 * 24 * time.Hour,
+	},
+	"1d": {
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		},
+		next: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		},
+		maxSpan: 366 * 24 * time.Hour,
+	},
+	"1mo": {
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		},
+		next: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		},
+		maxSpan: 5 * 366 * 24 * time.Hour,
+	},
+}
+
+// MinMaxMean summarizes a single field over a bucket.
+type MinMaxMean struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+
+	n   int
+	sum float64
+}
+
+// convert applies a unit conversion to the summary, if there is one.
+func (s *MinMaxMean) convert(f func(float64) float64) {
+	if s != nil {
+		s.Min, s.Max, s.Mean = f(s.Min), f(s.Max), f(s.Mean)
+	}
+}
+
+func (s *MinMaxMean) add(v float64) {
+	if s.n == 0 {
+		s.Min, s.Max = v, v
+	}
+	s.Min = math.Min(s.Min, v)
+	s.Max = math.Max(s.Max, v)
+	s.sum += v
+	s.n++
+}
+
+// done works out the mean. It returns nil if no readings were added.
+func (s *MinMaxMean) done() *MinMaxMean {
+	if s.n == 0 {
+		return nil
+	}
+	s.Mean = s.sum / float64(s.n)
+	return s
+}
+
+// AggregateBucket is the summary of all housestation_10min_all rows recorded in [Start, End). Readings
+// that failed QC are left out; a summary is null if all of its readings were.
+type AggregateBucket struct {
+	Start            time.Time   `json:"start"`
+	End              time.Time   `json:"end"`
+	Count            int         `json:"count"`
+	Excluded         int         `json:"excluded"` // Readings left out for failing QC
+	TempOutCur       *MinMaxMean `json:"TempOutCur"`
+	HumOutCur        *MinMaxMean `json:"HumOutCur"`
+	PressCur         *MinMaxMean `json:"PressCur"`
+	WindGust10Max    float64     `json:"WindGust10Max"`
+	RainTotal        float64     `json:"RainTotal"`
+	UVMax10Max       float64     `json:"UVMax10Max"`
+	SolarRadMax10Max float64     `json:"SolarRadMax10Max"`
+}
+
+// AggregateResult is the document returned by /api/aggregate.
+type AggregateResult struct {
+	Table    string            `json:"table"`
+	Bucket   string            `json:"bucket"`
+	Timezone string            `json:"timezone"`
+	From     time.Time         `json:"from"`
+	To       time.Time         `json:"to"`
+	Units    Units             `json:"units"`
+	Buckets  []AggregateBucket `json:"buckets"`
+}
+
+// Aggregate handles /api/aggregate?table=10min&bucket=1h|1d|1mo&from=...&to=...&units=... and returns
+// hourly, daily or monthly summaries of the 10 minute data. Buckets without any rows are left out.
+func (a *ApiHandlers) Aggregate(w http.ResponseWriter, r *http.Request) {
+	q, err := parseRangeParams(r, a.loc)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	units, err := parseUnitsParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v := r.URL.Query()
+	if t := v.Get("table"); t != "" && t != "10min" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported table %q, only 10min can be aggregated", t))
+		return
+	}
+	bucketName := v.Get("bucket")
+	bucket, ok := aggregateBuckets[bucketName]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid bucket parameter %q, expected one of 1h, 1d or 1mo", bucketName))
+		return
+	}
+	if q.To.Sub(q.From) > bucket.maxSpan {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s buckets can span at most %s", bucketName, bucket.maxSpan))
+		return
+	}
+
+	buckets, err := a.aggregateTenMin(q.From, q.To, bucket)
+	if err != nil {
+		jww.ERROR.Println(err)
+		writeError(w, http.StatusInternalServerError, "database query failed")
+		return
+	}
+	for i := range buckets {
+		b := &buckets[i]
+		b.TempOutCur.convert(units.temp)
+		b.PressCur.convert(units.pressure)
+		b.WindGust10Max = units.wind(b.WindGust10Max)
+		b.RainTotal = units.rain(b.RainTotal)
+	}
+
+	writeJSON(w, http.StatusOK, AggregateResult{
+		Table:    "10min",
+		Bucket:   bucketName,
+		Timezone: a.loc.String(),
+		From:     q.From,
+		To:       q.To,
+		Units:    units.Units(),
+		Buckets:  buckets,
+	})
+}
+
+// aggregateTenMin pages through the rows in [from, to) and folds them into buckets.
+//
+// RainDay is a running total that Meteobridge resets at local midnight, so the rain in a bucket is
+// the sum of the increases between consecutive rows, treating a decrease as a reset. The last row
+// before from is used as the starting point, so that rain in the first interval isn't lost. A RainDay
+// that failed QC is skipped, and the increase counted at the next one that passed.
+func (a *ApiHandlers) aggregateTenMin(from, to time.Time, bucket aggregateBucket) ([]AggregateBucket, error) {
+	res := make([]AggregateBucket, 0)
+	qc := newQCState()
+	a.primeTenMin(qc, from)
+
+	prevRain := math.NaN()
+	seed, err := a.store.TenMinRange(RangeQuery{From: from.Add(-1 * time.Hour), To: from, Limit: maxHistoryLimit})
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) > 0 {
+		prevRain = seed[len(seed)-1].RainDay
+	}
+
+	var cur *AggregateBucket
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		cur.TempOutCur = cur.TempOutCur.done()
+		cur.HumOutCur = cur.HumOutCur.done()
+		cur.PressCur = cur.PressCur.done()
+		cur.RainTotal = math.Floor(cur.RainTotal*100+0.5) / 100 // Undo float error; RainDay has 2 decimals
+		res = append(res, *cur)
+	}
+
+	cursor := 0
+	for {
+		rows, err := a.store.TenMinRange(RangeQuery{From: from, To: to, AfterID: cursor, Limit: maxHistoryLimit})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range rows {
+			t = qc.flagTenMin(t)
+			local := t.DateTime.In(a.loc)
+			start := bucket.start(local)
+			if cur == nil || !start.Equal(cur.Start) {
+				flush()
+				cur = &AggregateBucket{Start: start, End: bucket.next(start), TempOutCur: &MinMaxMean{}, HumOutCur: &MinMaxMean{}, PressCur: &MinMaxMean{}}
+			}
+
+			// passed reports whether the reading of field passed QC, and counts it as excluded if not.
+			passed := func(field string) bool {
+				if qcFlag(t, field) != QCOK {
+					cur.Excluded++
+					return false
+				}
+				return true
+			}
+			cur.Count++
+			if passed("TempOutCur") {
+				cur.TempOutCur.add(t.TempOutCur)
+			}
+			if passed("HumOutCur") {
+				cur.HumOutCur.add(float64(t.HumOutCur))
+			}
+			if passed("PressCur") {
+				cur.PressCur.add(t.PressCur)
+			}
+			if passed("WindGust10") {
+				cur.WindGust10Max = math.Max(cur.WindGust10Max, t.WindGust10)
+			}
+			if passed("UVMax10") {
+				cur.UVMax10Max = math.Max(cur.UVMax10Max, t.UVMax10)
+			}
+			if passed("SolarRadMax10") {
+				cur.SolarRadMax10Max = math.Max(cur.SolarRadMax10Max, t.SolarRadMax10)
+			}
+			if !passed("RainDay") {
+				continue
+			}
+
+			if !math.IsNaN(prevRain) {
+				d := t.RainDay - prevRain
+				if d < 0 {
+					d = t.RainDay
+				}
+				cur.RainTotal += d
+			}
+			prevRain = t.RainDay
+		}
+
+		if len(rows) < maxHistoryLimit {
+			break
+		}
+		cursor = rows[len(rows)-1].ID
+	}
+	flush()
+
+	return res, nil
+}
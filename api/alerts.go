@@ -0,0 +1,323 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// The number of cleared alerts /api/alerts remembers.
+	maxRecentAlerts = 50
+
+	// The number of alerts that can wait to be sent to the webhook. Any more are dropped.
+	webhookQueueSize = 100
+)
+
+// AlertRule raises an alert when a reading crosses a threshold, e.g. WindGust10 > 30. Values are in the
+// units readings are stored in (°F, mph, inHg, in).
+type AlertRule struct {
+	Name  string
+	Field string // A numeric column of the 10 minute or 15 second table
+	Table string // "10min" or "15sec". Defaults to the 10 minute table, unless only the 15 second one has Field
+	Op    string // >, >=, < or <=
+	Value float64
+
+	// How long the condition must hold before the alert fires. Zero fires on the first reading.
+	For time.Duration
+	// How far back past Value a reading has to go to clear the alert, so it doesn't flap.
+	Hysteresis float64
+	// The shortest time between two alerts of the rule.
+	Cooldown time.Duration
+}
+
+// Validate checks that r can be evaluated.
+func (r AlertRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rules need a name")
+	}
+	if _, err := r.table(); err != nil {
+		return fmt.Errorf("rule %q: %s", r.Name, err)
+	}
+	switch r.Op {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("rule %q: op must be >, >=, < or <=, got %q", r.Name, r.Op)
+	}
+	if r.For < 0 || r.Hysteresis < 0 || r.Cooldown < 0 {
+		return fmt.Errorf("rule %q: for, hysteresis and cooldown can't be negative", r.Name)
+	}
+	return nil
+}
+
+// table returns the type of the messages r applies to.
+func (r AlertRule) table() (MsgType, error) {
+	switch {
+	case r.Table != "" && r.Table != "10min" && r.Table != "15sec":
+		return "", fmt.Errorf("table must be 10min or 15sec, got %q", r.Table)
+	case r.Table != "15sec" && numericField(TenMinAllRow{}, r.Field):
+		return TenMinute, nil
+	case r.Table != "10min" && numericField(FifteenSecWindMsg{}, r.Field):
+		return FifteenSecWind, nil
+	}
+	return "", fmt.Errorf("%q isn't a numeric column of the 10min or 15sec table", r.Field)
+}
+
+// numericField reports whether row has a reading called name that's a number.
+func numericField(row interface{}, name string) bool {
+	f, ok := reflect.TypeOf(row).FieldByName(name)
+	if !ok || name == "ID" {
+		return false
+	}
+	switch f.Type.Kind() {
+	case reflect.Int, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// holds reports whether the rule's condition is true of v.
+func (r AlertRule) holds(v float64) bool {
+	switch r.Op {
+	case ">":
+		return v > r.Value
+	case ">=":
+		return v >= r.Value
+	case "<":
+		return v < r.Value
+	}
+	return v <= r.Value
+}
+
+// clears reports whether v is far enough back past the threshold to clear a firing alert.
+func (r AlertRule) clears(v float64) bool {
+	if r.Op == ">" || r.Op == ">=" {
+		return !r.holds(v + r.Hysteresis)
+	}
+	return !r.holds(v - r.Hysteresis)
+}
+
+func (r AlertRule) condition() string {
+	return fmt.Sprintf("%s %s %g", r.Field, r.Op, r.Value)
+}
+
+// AlertEvent is the payload of an Alert message, and what's POSTed to the webhook. It's sent when an
+// alert fires, and again when it clears. Times are those of the readings.
+type AlertEvent struct {
+	ID        int        `json:"id"`
+	Rule      string     `json:"rule"`
+	Condition string     `json:"condition"`
+	State     string     `json:"state"` // firing or cleared
+	Value     float64    `json:"value"` // The reading that fired or cleared the alert
+	Since     time.Time  `json:"since"` // When the condition started to hold
+	FiredAt   time.Time  `json:"firedAt"`
+	ClearedAt *time.Time `json:"clearedAt,omitempty"`
+}
+
+// AlertList is the document returned by /api/alerts. Recent holds cleared alerts, newest first.
+type AlertList struct {
+	Active []AlertEvent `json:"active"`
+	Recent []AlertEvent `json:"recent"`
+}
+
+// alertEngine holds the alert rules and where each one has got to.
+type alertEngine struct {
+	rules  []*alertRule
+	recent []AlertEvent
+	lastID int
+	sync.Mutex
+}
+
+type alertRule struct {
+	AlertRule
+	table     MsgType
+	since     time.Time // When the condition started to hold, zero if it doesn't
+	lastFired time.Time
+	active    *AlertEvent
+}
+
+// SetAlertRules replaces the alert rules, which should have been validated. Rules that haven't changed
+// carry on where they were; the alerts of any others are forgotten.
+func (a *ApiHandlers) SetAlertRules(rules []AlertRule) {
+	e := a.alerts
+	e.Lock()
+	defer e.Unlock()
+
+	old := make(map[AlertRule]*alertRule)
+	for _, r := range e.rules {
+		old[r.AlertRule] = r
+	}
+	e.rules = make([]*alertRule, 0, len(rules))
+	for _, r := range rules {
+		if o, ok := old[r]; ok {
+			e.rules = append(e.rules, o)
+			continue
+		}
+		t, err := r.table()
+		if err != nil {
+			jww.ERROR.Println("Ignoring alert rule:", err)
+			continue
+		}
+		e.rules = append(e.rules, &alertRule{AlertRule: r, table: t})
+	}
+}
+
+// SetAlertWebhook sets the URL alerts are POSTed to, and how long to wait for it. An empty URL turns
+// the webhook off.
+func (a *ApiHandlers) SetAlertWebhook(u string, timeout time.Duration) {
+	a.settingsMu.Lock()
+	a.alertWebhook = u
+	a.alertWebhookTimeout = timeout
+	a.settingsMu.Unlock()
+}
+
+// evaluate runs a new reading through the rules, and returns the alerts that fired or cleared.
+func (e *alertEngine) evaluate(msg WSMessage) []AlertEvent {
+	var at time.Time
+	switch p := msg.Payload.(type) {
+	case TenMinAllRow:
+		at = p.DateTime
+	case FifteenSecWindMsg:
+		at = p.DateTime
+	default:
+		return nil
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	res := make([]AlertEvent, 0)
+	for _, r := range e.rules {
+		if r.table != msg.MsgType {
+			continue
+		}
+		if qcFlag(msg.Payload, r.Field) != QCOK {
+			// A suspect reading neither fires nor clears an alert
+			continue
+		}
+		f := reflect.ValueOf(msg.Payload).FieldByName(r.Field)
+		v := float64(0)
+		if f.Kind() == reflect.Int {
+			v = float64(f.Int())
+		} else {
+			v = f.Float()
+		}
+
+		if r.active != nil {
+			if r.clears(v) {
+				ev := *r.active
+				ev.State, ev.Value, ev.ClearedAt = "cleared", v, &at
+				r.active, r.since = nil, time.Time{}
+				e.recent = append([]AlertEvent{ev}, e.recent...)
+				if len(e.recent) > maxRecentAlerts {
+					e.recent = e.recent[:maxRecentAlerts]
+				}
+				res = append(res, ev)
+			}
+			continue
+		}
+
+		if !r.holds(v) {
+			r.since = time.Time{}
+			continue
+		}
+		if r.since.IsZero() {
+			r.since = at
+		}
+		if at.Sub(r.since) < r.For || !r.lastFired.IsZero() && at.Sub(r.lastFired) < r.Cooldown {
+			continue
+		}
+		e.lastID++
+		ev := AlertEvent{ID: e.lastID, Rule: r.Name, Condition: r.condition(), State: "firing", Value: v, Since: r.since, FiredAt: at}
+		r.active, r.lastFired = &ev, at
+		res = append(res, ev)
+	}
+	return res
+}
+
+// active lists the alerts that are firing, in the order of the rules.
+func (e *alertEngine) active() []AlertEvent {
+	e.Lock()
+	defer e.Unlock()
+	res := make([]AlertEvent, 0)
+	for _, r := range e.rules {
+		if r.active != nil {
+			res = append(res, *r.active)
+		}
+	}
+	return res
+}
+
+// Alerts handles /api/alerts, and lists the alerts that are firing and the ones that have recently cleared.
+func (a *ApiHandlers) Alerts(w http.ResponseWriter, r *http.Request) {
+	list := AlertList{Active: a.alerts.active()}
+	a.alerts.Lock()
+	list.Recent = append(make([]AlertEvent, 0, len(a.alerts.recent)), a.alerts.recent...)
+	a.alerts.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// checkAlerts runs new readings through the alert rules, and tells subscribers and the webhook about
+// alerts that fire or clear. It must only be called from runMonitor.
+func (a *ApiHandlers) checkAlerts(results []WSMessage) {
+	msgs := make([]WSMessage, 0)
+	for _, r := range results {
+		for _, ev := range a.alerts.evaluate(r) {
+			jww.INFO.Println("Alert", ev.Rule, ev.State+":", ev.Condition, "with", ev.Value)
+			msgs = append(msgs, WSMessage{MsgType: Alert, Payload: ev})
+			select {
+			case a.webhooks <- ev:
+			default:
+				jww.ERROR.Println("The webhook is falling behind, dropped alert", ev.ID)
+			}
+		}
+	}
+	if len(msgs) > 0 {
+		a.notifySubscribers(msgs)
+	}
+}
+
+// sendWebhooks sends the queued alerts to the webhook one at a time, so they arrive in order, in a
+// goroutine of its own so a slow receiver can't hold up the monitor. It returns once runMonitor has
+// closed the queue and it's been emptied.
+func (a *ApiHandlers) sendWebhooks() {
+	defer close(a.webhooksDone)
+	for ev := range a.webhooks {
+		a.sendWebhook(ev)
+	}
+}
+
+// sendWebhook POSTs an alert to the webhook as JSON. Failures are logged, and not retried.
+func (a *ApiHandlers) sendWebhook(ev AlertEvent) {
+	a.settingsMu.RLock()
+	u, timeout := a.alertWebhook, a.alertWebhookTimeout
+	a.settingsMu.RUnlock()
+	if u == "" {
+		return
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		jww.ERROR.Println(err)
+		return
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Leave out the URL, which may hold a secret
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		jww.ERROR.Println("Couldn't send alert", ev.ID, "to the webhook:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		jww.ERROR.Println("The webhook rejected alert", ev.ID, "with", resp.Status)
+	}
+}
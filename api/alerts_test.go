@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAlertWebhook(t *testing.T) {
+	posts := make(chan AlertEvent, 10)
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected %s request with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var ev AlertEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		posts <- ev
+	}))
+	defer recv.Close()
+
+	a := NewApiHandlers(NewMemoryStore(), time.UTC)
+	a.SetAlertWebhook(recv.URL, time.Second)
+	rule := AlertRule{Name: "Frost", Field: "TempOutCur", Op: "<", Value: 33, For: 30 * time.Minute, Hysteresis: 1, Cooldown: 2 * time.Hour}
+	if err := rule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	a.SetAlertRules([]AlertRule{rule})
+
+	// One reading every 10 minutes.
+	temps := []float64{
+		35,
+		32, 32, 32, 32, // Fires 30 minutes after it first drops below 33
+		33.5, 33.9, 40, // Not past 33 + 1 yet, and 40 is suspect
+		34,         // Clears
+		32, 32, 32, // Held for 30 minutes again, but within the cooldown
+		32, 32, 32, 32, 32, // Fires 2 hours after it last fired
+		31,
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(i int) time.Time {
+		return t0.Add(time.Duration(i) * 10 * time.Minute)
+	}
+	for i, v := range temps {
+		row := TenMinAllRow{DateTime: at(i), TempOutCur: v, qc: QCFlags{"TempOutCur": QCOK}}
+		if v == 40 {
+			row.qc["TempOutCur"] = QCRange
+		}
+		a.checkAlerts([]WSMessage{{MsgType: TenMinute, Payload: row}})
+	}
+
+	got := make([]AlertEvent, 0)
+	timeout := time.After(5 * time.Second)
+	for len(got) < 3 {
+		select {
+		case ev := <-posts:
+			got = append(got, ev)
+		case <-timeout:
+			t.Fatalf("expected 3 webhook calls, got %+v", got)
+		}
+	}
+	select {
+	case ev := <-posts:
+		t.Fatalf("unexpected webhook call %+v", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	fired, cleared, refired := got[0], got[1], got[2]
+	if fired.ID != 1 || fired.State != "firing" || fired.Value != 32 || !fired.Since.Equal(at(1)) || !fired.FiredAt.Equal(at(4)) {
+		t.Errorf("unexpected first alert %+v", fired)
+	}
+	if fired.Condition != "TempOutCur < 33" {
+		t.Errorf("condition = %q", fired.Condition)
+	}
+	if cleared.ID != 1 || cleared.State != "cleared" || cleared.Value != 34 || cleared.ClearedAt == nil || !cleared.ClearedAt.Equal(at(8)) {
+		t.Errorf("unexpected clear %+v", cleared)
+	}
+	if refired.ID != 2 || refired.State != "firing" || !refired.Since.Equal(at(9)) || !refired.FiredAt.Equal(at(16)) {
+		t.Errorf("unexpected second alert %+v", refired)
+	}
+
+	if active := a.alerts.active(); len(active) != 1 || active[0].ID != 2 {
+		t.Errorf("expected alert 2 to be active, got %+v", active)
+	}
+}
+
+func TestShutdownSendsQueuedAlerts(t *testing.T) {
+	var mu sync.Mutex
+	got := make([]int, 0)
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev AlertEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		got = append(got, ev.ID)
+		mu.Unlock()
+	}))
+	defer recv.Close()
+
+	a := NewApiHandlers(NewMemoryStore(), time.UTC)
+	a.SetAlertWebhook(recv.URL, time.Second)
+	a.SetAlertRules([]AlertRule{{Name: "Hot", Field: "TempOutCur", Op: ">", Value: 90}})
+
+	// Five alerts, each firing and then clearing.
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		row := TenMinAllRow{DateTime: t0.Add(time.Duration(i) * 10 * time.Minute), TempOutCur: float64(80 + i%2*20), qc: QCFlags{"TempOutCur": QCOK}}
+		a.checkAlerts([]WSMessage{{MsgType: TenMinute, Payload: row}})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != nil {
+		t.Fatal("Shutdown:", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []int{1, 1, 2, 2, 3, 3, 4, 4, 5}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("webhook got alerts %v, want %v", got, want)
+	}
+}
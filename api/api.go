@@ -1,11 +1,120 @@
 package api
 
 import (
-	//"database/sql"
-	//_ "github.com/go-sql-driver/mysql"
+	"encoding/json"
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// CurrentConditions is the document returned by /api/current. It merges the most recent row of each
+// table the monitor has seen, along with how old each reading is at the time of the request.
+type CurrentConditions struct {
+	TenMinute         interface{}  `json:"tenMinute"` // A TenMinOut, rendered as the request asks
+	TenMinuteAge      *float64     `json:"tenMinuteAgeSeconds"`
+	FifteenSecWind    interface{}  `json:"fifteenSecWind"` // A FifteenSecWindOut
+	FifteenSecWindAge *float64     `json:"fifteenSecWindAgeSeconds"`
+	Units             Units        `json:"units"`
+	Status            SourceStatus `json:"status"`
+	GeneratedAt       time.Time    `json:"generatedAt"`
+}
+
+// Current returns a JSON snapshot of the latest readings the monitor has cached. Clients can poll it
+// cheaply: the ETag changes only when a new row arrives or the database goes offline or comes back, and
+// conditional requests get a 304.
+// ?units=metric|imperial|si picks the units readings are given in, and ?suspect=null replaces readings
+// that failed QC with null.
 func (a *ApiHandlers) Current(w http.ResponseWriter, r *http.Request) {
+	units, err := parseUnitsParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	null, err := parseSuspectParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	cur := CurrentConditions{GeneratedAt: now, Units: units.Units()}
+	var lastModified time.Time
+	tenMinID, windID := 0, 0
+
+	a.monitor.RLock()
+	cur.Status = a.monitor.status
+	if t, ok := a.monitor.latestTenMinRes.Payload.(TenMinAllRow); ok {
+		age := now.Sub(t.DateTime).Seconds()
+		cur.TenMinute, cur.TenMinuteAge = tenMinOut(t, units).render(nil, null), &age
+		tenMinID = t.ID
+		lastModified = t.DateTime
+	}
+	if f, ok := a.monitor.latestFifteenSecRes.Payload.(FifteenSecWindMsg); ok {
+		age := now.Sub(f.DateTime).Seconds()
+		cur.FifteenSecWind, cur.FifteenSecWindAge = windOut(f, units).render(null), &age
+		windID = f.ID
+		if f.DateTime.After(lastModified) {
+			lastModified = f.DateTime
+		}
+	}
+	a.monitor.RUnlock()
+	if cur.Status.Since.After(lastModified) {
+		lastModified = cur.Status.Since
+	}
+
+	if cur.TenMinute == nil && cur.FifteenSecWind == nil {
+		writeError(w, http.StatusServiceUnavailable, "no readings have been received yet")
+		return
+	}
+
+	etag := fmt.Sprintf(`"%d-%d-%s-%t-%t-%d"`, tenMinID, windID, units, null, cur.Status.Online, cur.Status.Since.Unix())
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, cur)
+}
+
+// notModified reports whether the request's conditional headers match the current representation.
+// If-None-Match takes precedence over If-Modified-Since, as per RFC 7232, and lists ETags that are
+// compared weakly, ignoring any W/ prefix.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := strings.Join(r.Header["If-None-Match"], ","); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON serializes v as the body of the response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		jww.ERROR.Println("Failed to write JSON response:", err)
+	}
+}
 
+// writeError sends a JSON error document of the form {"error": msg}.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
 }
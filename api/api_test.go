@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	etag := `"12-34-imperial-false-true-0"`
+	modified := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		value  string
+		want   bool
+	}{
+		{"If-None-Match", etag, true},
+		{"If-None-Match", `"11-34-imperial-false-true-0"`, false},
+		{"If-None-Match", "*", true},
+		{"If-None-Match", "W/" + etag, true},
+		{"If-None-Match", `"a", ` + etag + `, "b"`, true},
+		{"If-None-Match", `"a", W/"b"`, false},
+		{"If-Modified-Since", "Wed, 01 Jun 2016 12:00:00 GMT", true},
+		{"If-Modified-Since", "Wed, 01 Jun 2016 11:59:59 GMT", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/current", nil)
+		r.Header.Set(tt.header, tt.value)
+		if got := notModified(r, etag, modified); got != tt.want {
+			t.Errorf("%s: %s = %t, want %t", tt.header, tt.value, got, tt.want)
+		}
+	}
+
+	// If-None-Match takes precedence, and may be split over several header lines.
+	r := httptest.NewRequest("GET", "/api/current", nil)
+	r.Header.Add("If-None-Match", `"a"`)
+	r.Header.Add("If-None-Match", etag)
+	r.Header.Set("If-Modified-Since", "Wed, 01 Jun 2016 11:00:00 GMT")
+	if !notModified(r, etag, modified) {
+		t.Error("expected a match on the second If-None-Match header")
+	}
+}
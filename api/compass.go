@@ -0,0 +1,36 @@
+package api
+
+import (
+	"math"
+)
+
+// The 16 points of the compass, in the same abbreviated form Meteobridge writes to the *Eng columns.
+var compassPoints = []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+
+// The names of the compassPoints.
+var compassNames = []string{
+	"North", "North-northeast", "Northeast", "East-northeast", "East", "East-southeast", "Southeast", "South-southeast",
+	"South", "South-southwest", "Southwest", "West-southwest", "West", "West-northwest", "Northwest", "North-northwest",
+}
+
+// compassIndex returns the index of the compass point nearest to a bearing in degrees.
+func compassIndex(deg int) int {
+	return int(math.Floor(float64((deg%360+360)%360)/22.5+0.5)) % 16
+}
+
+// compassPoint converts a bearing in degrees to the nearest of the 16 compass points.
+func compassPoint(deg int) string {
+	return compassPoints[compassIndex(deg)]
+}
+
+// compassName is like compassPoint, but spells the point out.
+func compassName(deg int) string {
+	return compassNames[compassIndex(deg)]
+}
+
+// meanDirection returns the circular mean, in whole degrees [0, 360), of a set of bearings given the
+// sums of their sines and cosines. A plain average would put the mean of 350 and 10 at 180.
+func meanDirection(sumSin, sumCos float64) int {
+	deg := int(math.Floor(math.Atan2(sumSin, sumCos)*180/math.Pi + 0.5))
+	return (deg + 360) % 360
+}
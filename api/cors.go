@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SetCORSOrigins sets the origins (e.g. "https://dashboard.example.com") of the web pages allowed to
+// call the API and open WebSockets to it. "*" allows any page. Pages served by WeatherMoss itself are
+// always allowed.
+func (a *ApiHandlers) SetCORSOrigins(origins []string) {
+	a.settingsMu.Lock()
+	a.corsOrigins = append([]string(nil), origins...)
+	a.settingsMu.Unlock()
+}
+
+// originAllowed reports whether origin is one of the configured CORS origins.
+func (a *ApiHandlers) originAllowed(origin string) bool {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	for _, o := range a.corsOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin is the WebSocket upgrader's CheckOrigin. Like gorilla's default it accepts requests
+// without an Origin and from the same host, and it also accepts the configured CORS origins.
+func (a *ApiHandlers) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return a.originAllowed(origin)
+}
+
+// CORS wraps h, adding CORS headers to the responses to allowed origins and answering their preflight
+// requests.
+func (a *ApiHandlers) CORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !a.originAllowed(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-None-Match, If-Modified-Since, Last-Event-ID")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
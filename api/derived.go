@@ -0,0 +1,134 @@
+package api
+
+import (
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Derived holds values calculated from a 10 minute row, that Meteobridge doesn't record. Temperatures
+// are in the units the row is served in, and CloudBase in feet (imperial) or metres. AbsoluteHumidity
+// is always in g/m³, and VaporPressureDeficit in kPa.
+type Derived struct {
+	ApparentTemp         float64 `json:"apparentTemp"`
+	WetBulbTemp          float64 `json:"wetBulbTemp"`
+	AbsoluteHumidity     float64 `json:"absoluteHumidity"`
+	CloudBase            float64 `json:"cloudBase"`
+	VaporPressureDeficit float64 `json:"vaporPressureDeficit"`
+	WindDirPoint         string  `json:"windDirPoint"`
+	WindDirName          string  `json:"windDirName"`
+	Beaufort             int     `json:"beaufort"`
+	BeaufortName         string  `json:"beaufortName"`
+}
+
+// derive calculates the Derived values of t, which is in the imperial units it's stored in. The wind
+// descriptors use the 10 minute average speed and direction.
+func derive(t TenMinAllRow, u UnitSystem) Derived {
+	tc := fahrenheitToCelsius(t.TempOutCur)
+	rh := float64(t.HumOutCur)
+	ms := t.WindAvgSpeedCur * 0.44704
+
+	force := beaufort(ms)
+	return Derived{
+		ApparentTemp:         u.tempC(apparentTemp(tc, rh, ms)),
+		WetBulbTemp:          u.tempC(wetBulbTemp(tc, rh)),
+		AbsoluteHumidity:     round(absoluteHumidity(tc, rh), 2),
+		CloudBase:            u.height(cloudBase(tc, fahrenheitToCelsius(t.DewCur))),
+		VaporPressureDeficit: round(vaporPressureDeficit(tc, rh), 2),
+		WindDirPoint:         compassPoint(t.WindDirAvg10),
+		WindDirName:          compassName(t.WindDirAvg10),
+		Beaufort:             force,
+		BeaufortName:         beaufortNames[force],
+	}
+}
+
+// The columns each Derived value is calculated from, by JSON name.
+var derivedInputs = map[string][]string{
+	"apparentTemp":         {"TempOutCur", "HumOutCur", "WindAvgSpeedCur"},
+	"wetBulbTemp":          {"TempOutCur", "HumOutCur"},
+	"absoluteHumidity":     {"TempOutCur", "HumOutCur"},
+	"cloudBase":            {"TempOutCur", "DewCur"},
+	"vaporPressureDeficit": {"TempOutCur", "HumOutCur"},
+	"windDirPoint":         {"WindDirAvg10"},
+	"windDirName":          {"WindDirAvg10"},
+	"beaufort":             {"WindAvgSpeedCur"},
+	"beaufortName":         {"WindAvgSpeedCur"},
+}
+
+// null returns d as a map, with the values calculated from readings that failed QC replaced by nil.
+func (d Derived) null(q QCFlags) map[string]interface{} {
+	rv := reflect.ValueOf(d)
+	m := make(map[string]interface{}, rv.NumField())
+	for i := 0; i < rv.NumField(); i++ {
+		name := strings.Split(rv.Type().Field(i).Tag.Get("json"), ",")[0]
+		m[name] = rv.Field(i).Interface()
+		for _, f := range derivedInputs[name] {
+			if flag, ok := q[f]; ok && flag != QCOK {
+				m[name] = nil
+				break
+			}
+		}
+	}
+	return m
+}
+
+func fahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+// saturationVaporPressure returns the saturation vapour pressure over water at tc °C, in hPa, using
+// the Magnus formula with the coefficients of Alduchov and Eskridge (1996).
+func saturationVaporPressure(tc float64) float64 {
+	return 6.1094 * math.Exp(17.625*tc/(tc+243.04))
+}
+
+// apparentTemp is the Australian Bureau of Meteorology's apparent temperature (Steadman, 1994), without
+// solar radiation, in °C. rh is the relative humidity in percent and ms the wind speed in m/s.
+func apparentTemp(tc, rh, ms float64) float64 {
+	e := rh / 100 * saturationVaporPressure(tc)
+	return tc + 0.33*e - 0.70*ms - 4.00
+}
+
+// wetBulbTemp estimates the wet-bulb temperature in °C at standard sea level pressure, using Stull's
+// (2011) empirical formula. It's accurate to within 1°C for humidities from 5% to 99%.
+func wetBulbTemp(tc, rh float64) float64 {
+	return tc*math.Atan(0.151977*math.Sqrt(rh+8.313659)) +
+		math.Atan(tc+rh) - math.Atan(rh-1.676331) +
+		0.00391838*math.Pow(rh, 1.5)*math.Atan(0.023101*rh) -
+		4.686035
+}
+
+// absoluteHumidity returns the mass of water vapour in a cubic metre of air, in grams.
+func absoluteHumidity(tc, rh float64) float64 {
+	e := rh / 100 * saturationVaporPressure(tc) * 100 // Pa
+	return 1000 * e / (461.5 * (tc + 273.15))
+}
+
+// cloudBase estimates the height of the base of convective cloud above the station, in metres, from
+// the spread between the temperature and dew point: about 125 m for each °C.
+func cloudBase(tc, dewc float64) float64 {
+	return math.Max(0, (tc-dewc)*125)
+}
+
+// vaporPressureDeficit returns the difference between the saturation and actual vapour pressure, in kPa.
+func vaporPressureDeficit(tc, rh float64) float64 {
+	return saturationVaporPressure(tc) / 10 * (1 - rh/100)
+}
+
+// Upper limits, in m/s, of forces 0 to 11 of the Beaufort scale.
+var beaufortLimits = []float64{0.5, 1.6, 3.4, 5.5, 8.0, 10.8, 13.9, 17.2, 20.8, 24.5, 28.5, 32.7}
+
+var beaufortNames = []string{
+	"Calm", "Light air", "Light breeze", "Gentle breeze", "Moderate breeze", "Fresh breeze", "Strong breeze",
+	"Near gale", "Gale", "Strong gale", "Storm", "Violent storm", "Hurricane force",
+}
+
+// beaufort returns the Beaufort force of a wind speed in m/s.
+func beaufort(ms float64) int {
+	for f, limit := range beaufortLimits {
+		if ms < limit {
+			return f
+		}
+	}
+	return len(beaufortLimits)
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checkNear(t *testing.T, name string, got, want, tolerance float64) {
+	if math.Abs(got-want) > tolerance {
+		t.Errorf("%s = %.3f, want %.3f ± %g", name, got, want, tolerance)
+	}
+}
+
+func TestWetBulbTemp(t *testing.T) {
+	// The worked example in Stull (2011).
+	checkNear(t, "wetBulbTemp(20, 50)", wetBulbTemp(20, 50), 13.7, 0.05)
+	// Psychrometric tables, at sea level pressure. The formula is good to about 0.3°C in this range.
+	checkNear(t, "wetBulbTemp(30, 40)", wetBulbTemp(30, 40), 20.2, 0.3)
+	checkNear(t, "wetBulbTemp(10, 80)", wetBulbTemp(10, 80), 8.0, 0.3)
+}
+
+func TestApparentTemp(t *testing.T) {
+	// Worked from the definition the Bureau of Meteorology publishes at bom.gov.au/info/thermal_stress,
+	// AT = Ta + 0.33e - 0.70ws - 4.00 with e = rh/100 × 6.105 exp(17.27 Ta / (237.7 + Ta)). Its vapour
+	// pressure formula differs from saturationVaporPressure by well under 0.1%.
+	checkNear(t, "apparentTemp(30, 50, 0)", apparentTemp(30, 50, 0), 32.98, 0.02)
+	checkNear(t, "apparentTemp(30, 50, 5)", apparentTemp(30, 50, 5), 29.48, 0.02)
+	checkNear(t, "apparentTemp(15, 70, 3)", apparentTemp(15, 70, 3), 12.83, 0.02)
+	checkNear(t, "apparentTemp(35, 20, 2)", apparentTemp(35, 20, 2), 33.30, 0.02)
+}
+
+func TestAbsoluteHumidity(t *testing.T) {
+	// Saturated air holds 17.3 g/m³ at 20°C, and 30.4 g/m³ at 30°C. The Magnus formula is good to
+	// about 0.5%.
+	checkNear(t, "absoluteHumidity(20, 100)", absoluteHumidity(20, 100), 17.3, 0.09)
+	checkNear(t, "absoluteHumidity(20, 50)", absoluteHumidity(20, 50), 8.65, 0.05)
+	checkNear(t, "absoluteHumidity(30, 100)", absoluteHumidity(30, 100), 30.4, 0.15)
+}
+
+func TestVaporPressureDeficit(t *testing.T) {
+	// The saturation vapour pressure is 3.17 kPa at 25°C, and 1.23 kPa at 10°C.
+	checkNear(t, "vaporPressureDeficit(25, 50)", vaporPressureDeficit(25, 50), 1.58, 0.01)
+	checkNear(t, "vaporPressureDeficit(10, 80)", vaporPressureDeficit(10, 80), 0.25, 0.01)
+	checkNear(t, "vaporPressureDeficit(25, 100)", vaporPressureDeficit(25, 100), 0, 0)
+}
+
+func TestCloudBase(t *testing.T) {
+	// The FAA's rule of thumb, 1,000 ft for every 4.4°F of spread (Pilot's Handbook of Aeronautical
+	// Knowledge, FAA-H-8083-25), which agrees with Lawrence's (2005) 125 m per °C to within 0.3%.
+	checkNear(t, "cloudBase(80°F, 62°F)", cloudBase(fahrenheitToCelsius(80), fahrenheitToCelsius(62)), 4091*0.3048, 5)
+	checkNear(t, "cloudBase(70°F, 48°F)", cloudBase(fahrenheitToCelsius(70), fahrenheitToCelsius(48)), 5000*0.3048, 5)
+	checkNear(t, "cloudBase(15, 15)", cloudBase(15, 15), 0, 0)
+	// A dew point above the temperature is bad data, not cloud below ground.
+	checkNear(t, "cloudBase(10, 12)", cloudBase(10, 12), 0, 0)
+}
+
+func TestBeaufort(t *testing.T) {
+	if got := beaufort(0); got != 0 {
+		t.Errorf("beaufort(0) = %d, want 0", got)
+	}
+	// Each limit is the lowest speed of the next force.
+	for force, limit := range beaufortLimits {
+		if got := beaufort(limit - 0.01); got != force {
+			t.Errorf("beaufort(%g) = %d, want %d", limit-0.01, got, force)
+		}
+		if got := beaufort(limit); got != force+1 {
+			t.Errorf("beaufort(%g) = %d, want %d", limit, got, force+1)
+		}
+	}
+	if got := beaufort(60); got != 12 || beaufortNames[got] != "Hurricane force" {
+		t.Errorf("beaufort(60) = %d, want 12", got)
+	}
+}
+
+func TestCompassPoint(t *testing.T) {
+	tests := []struct {
+		deg   int
+		point string
+		name  string
+	}{
+		{0, "N", "North"},
+		{11, "N", "North"},
+		{12, "NNE", "North-northeast"},
+		{90, "E", "East"},
+		{348, "NNW", "North-northwest"}, // N starts at 348.75
+		{349, "N", "North"},
+		{360, "N", "North"},
+		{-90, "W", "West"},
+	}
+	for _, tt := range tests {
+		if got := compassPoint(tt.deg); got != tt.point {
+			t.Errorf("compassPoint(%d) = %q, want %q", tt.deg, got, tt.point)
+		}
+		if got := compassName(tt.deg); got != tt.name {
+			t.Errorf("compassName(%d) = %q, want %q", tt.deg, got, tt.name)
+		}
+	}
+}
+
+func TestDeriveUnits(t *testing.T) {
+	row := TenMinAllRow{TempOutCur: 68, HumOutCur: 50, DewCur: 50, WindAvgSpeedCur: 10, WindDirAvg10: 200}
+	d := derive(row, Metric)
+	checkNear(t, "metric wetBulbTemp", d.WetBulbTemp, 13.7, 0.05)
+	checkNear(t, "metric cloudBase", d.CloudBase, 1250, 0)
+	if d.WindDirPoint != "SSW" || d.Beaufort != 3 {
+		t.Errorf("unexpected wind descriptors %+v", d)
+	}
+
+	d = derive(row, Imperial)
+	checkNear(t, "imperial wetBulbTemp", d.WetBulbTemp, 56.7, 0.1)
+	checkNear(t, "imperial cloudBase", d.CloudBase, 4101, 0)
+	if d.AbsoluteHumidity != derive(row, SI).AbsoluteHumidity {
+		t.Error("absoluteHumidity should be in g/m³ in every unit system")
+	}
+}
+
+func TestDerivedSuspectInputs(t *testing.T) {
+	row := TenMinAllRow{DateTime: time.Now(), TempOutCur: 68, HumOutCur: 50, DewCur: 50, WindAvgSpeedCur: 10, WindDirAvg10: 200}
+	row.qc = QCFlags{"TempOutCur": QCOK, "HumOutCur": QCOK, "DewCur": QCStep, "WindAvgSpeedCur": QCOK, "WindDirAvg10": QCOK}
+
+	b, err := json.Marshal(tenMinOut(row, Imperial).render(nil, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	for _, want := range []string{`"DewCur":null`, `"cloudBase":null`, `"wetBulbTemp":56.7`, `"windDirPoint":"SSW"`} {
+		if !strings.Contains(s, want) {
+			t.Errorf("expected %s in %s", want, s)
+		}
+	}
+
+	// Without ?suspect=null, everything is sent as calculated.
+	b, _ = json.Marshal(tenMinOut(row, Imperial).render(nil, false))
+	if !strings.Contains(string(b), `"cloudBase":4101`) {
+		t.Errorf("expected the cloud base in %s", b)
+	}
+}
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// The pressure tendency is the change over this long.
+	tendencyPeriod = 3 * time.Hour
+
+	// How far from 3 hours (and 1½ hours) ago the rows the tendency is worked out from may be.
+	tendencySlack = 30 * time.Minute
+
+	// Changes over 3 hours smaller than this many hPa count as steady, as in Zambretti's forecaster.
+	// PressCur is recorded to 0.01 inHg (0.34 hPa), so this is about five steps of the barometer.
+	steadyPressureChange = 1.6
+)
+
+// PressureTendency describes how the pressure has changed over the last 3 hours. Code and
+// Characteristic are from WMO code table 0200, which also says whether the change was steady.
+type PressureTendency struct {
+	Change         float64 `json:"change"`   // In the pressure unit
+	Tendency       string  `json:"tendency"` // rising, steady or falling
+	Code           int     `json:"code"`
+	Characteristic string  `json:"characteristic"`
+}
+
+// LocalForecast is the payload of a Forecast message, and the document returned by /api/forecast/local.
+// It's a short-range outlook for the next 12 hours or so, worked out from the barometer and the wind
+// alone with Negretti & Zambra's "Zambretti" forecaster, for the northern hemisphere.
+type LocalForecast struct {
+	DateTime  time.Time        `json:"dateTime"` // Of the newest reading it's based on
+	Pressure  float64          `json:"pressure"`
+	Tendency  PressureTendency `json:"tendency"`
+	WindDir   string           `json:"windDir"`   // The 10 minute average direction, empty if calm
+	Zambretti string           `json:"zambretti"` // The forecast's letter, A (settled fine) to Z (stormy, much rain)
+	Forecast  string           `json:"forecast"`
+	Units     *Units           `json:"units,omitempty"`
+}
+
+// changed reports whether the outlook in f differs from old's.
+func (f LocalForecast) changed(old *LocalForecast) bool {
+	return old == nil || f.Zambretti != old.Zambretti || f.Tendency.Code != old.Tendency.Code || f.Tendency.Tendency != old.Tendency.Tendency
+}
+
+// forecast converts a forecast's pressures to u.
+func (u UnitSystem) forecast(f LocalForecast) LocalForecast {
+	f.Pressure = u.pressure(f.Pressure)
+	f.Tendency.Change = u.pressure(f.Tendency.Change)
+	return f
+}
+
+// LocalForecastHandler handles /api/forecast/local?units=... and returns the latest local forecast.
+func (a *ApiHandlers) LocalForecastHandler(w http.ResponseWriter, r *http.Request) {
+	units, err := parseUnitsParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	a.monitor.RLock()
+	f := a.monitor.forecast
+	a.monitor.RUnlock()
+	if f == nil {
+		writeError(w, http.StatusServiceUnavailable, "not enough pressure history for a forecast yet")
+		return
+	}
+
+	res := units.forecast(*f)
+	set := units.Units()
+	res.Units = &set
+	writeJSON(w, http.StatusOK, res)
+}
+
+// updateForecast works the forecast out again when a new 10 minute row arrives, and tells subscribers
+// if the outlook has changed. It must only be called from runMonitor.
+func (a *ApiHandlers) updateForecast(results []WSMessage) {
+	var latest *TenMinAllRow
+	for _, r := range results {
+		if t, ok := r.Payload.(TenMinAllRow); ok {
+			latest = &t
+		}
+	}
+	if latest == nil {
+		return
+	}
+
+	f, err := a.localForecast(*latest)
+	if err != nil {
+		jww.INFO.Println("No local forecast:", err)
+		return
+	}
+
+	a.monitor.Lock()
+	old := a.monitor.forecast
+	a.monitor.forecast = &f
+	a.monitor.Unlock()
+	if f.changed(old) {
+		a.notifySubscribers([]WSMessage{{MsgType: Forecast, Payload: f}})
+	}
+}
+
+// localForecast works out the forecast as of the row t, using the rows stored over the 3 hours before it.
+func (a *ApiHandlers) localForecast(t TenMinAllRow) (LocalForecast, error) {
+	from := t.DateTime.Add(-tendencyPeriod - tendencySlack)
+	rows, err := a.store.TenMinRange(RangeQuery{From: from, To: t.DateTime, Limit: maxHistoryLimit})
+	if err != nil {
+		return LocalForecast{}, err
+	}
+	start, ok := nearestRow(rows, t.DateTime.Add(-tendencyPeriod))
+	if !ok {
+		return LocalForecast{}, fmt.Errorf("no reading from around %s ago", tendencyPeriod)
+	}
+	mid, ok := nearestRow(rows, t.DateTime.Add(-tendencyPeriod/2))
+	if !ok {
+		return LocalForecast{}, fmt.Errorf("no reading from around %s ago", tendencyPeriod/2)
+	}
+
+	// The tendency and Zambretti's tables are in hPa, but PressCur is in inHg like everything else.
+	hPa := func(inHg float64) float64 { return inHg * 33.8638866667 }
+	code, tendency := pressureTendency(hPa(start.PressCur), hPa(mid.PressCur), hPa(t.PressCur))
+
+	f := LocalForecast{
+		DateTime: t.DateTime,
+		Pressure: t.PressCur,
+		Tendency: PressureTendency{
+			Change:         round(t.PressCur-start.PressCur, 2),
+			Tendency:       tendency,
+			Code:           code,
+			Characteristic: tendencyCharacteristics[code],
+		},
+	}
+	calm := t.WindAvgSpeedCur == 0
+	if !calm {
+		f.WindDir = compassPoint(t.WindDirAvg10)
+	}
+	letter := zambretti(hPa(t.PressCur), tendency, t.WindDirAvg10, calm, t.DateTime.Month())
+	f.Zambretti = string(rune('A' + letter))
+	f.Forecast = zambrettiForecasts[letter]
+	return f, nil
+}
+
+// nearestRow returns the row recorded closest to at, if there's one within tendencySlack of it.
+func nearestRow(rows []TenMinAllRow, at time.Time) (TenMinAllRow, bool) {
+	var best TenMinAllRow
+	bestDiff := tendencySlack + 1
+	for _, r := range rows {
+		d := r.DateTime.Sub(at)
+		if d < 0 {
+			d = -d
+		}
+		if d < bestDiff {
+			best, bestDiff = r, d
+		}
+	}
+	return best, bestDiff <= tendencySlack
+}
+
+// Descriptions of the pressure tendency codes in WMO code table 0200.
+var tendencyCharacteristics = []string{
+	"Increasing, then decreasing",
+	"Increasing, then steady; or increasing, then increasing more slowly",
+	"Increasing (steadily or unsteadily)",
+	"Decreasing or steady, then increasing; or increasing, then increasing more rapidly",
+	"Steady",
+	"Decreasing, then increasing",
+	"Decreasing, then steady; or decreasing, then decreasing more slowly",
+	"Decreasing (steadily or unsteadily)",
+	"Steady or increasing, then decreasing; or decreasing, then decreasing more rapidly",
+}
+
+// pressureTendency classifies the change between the pressures 3 hours ago, 1½ hours ago and now, all
+// in hPa, by the WMO pressure tendency code and as rising, steady or falling. The shape of the change
+// is judged from its two halves.
+func pressureTendency(start, mid, end float64) (int, string) {
+	step := steadyPressureChange / 2
+	sign := func(d float64) int {
+		switch {
+		case d >= step:
+			return 1
+		case d <= -step:
+			return -1
+		}
+		return 0
+	}
+	d1, d2, total := mid-start, end-mid, end-start
+	s1, s2 := sign(d1), sign(d2)
+
+	switch {
+	case math.Abs(total) < steadyPressureChange:
+		switch {
+		case s1 > 0 && s2 < 0:
+			return 0, "steady"
+		case s1 < 0 && s2 > 0:
+			return 5, "steady"
+		}
+		return 4, "steady"
+	case total > 0:
+		switch {
+		case s1 > 0 && s2 < 0:
+			return 0, "rising"
+		case s1 <= 0 && s2 > 0, s1 > 0 && d2-d1 >= step:
+			return 3, "rising"
+		case s1 > 0 && (s2 == 0 || d1-d2 >= step):
+			return 1, "rising"
+		}
+		return 2, "rising"
+	default:
+		switch {
+		case s1 < 0 && s2 > 0:
+			return 5, "falling"
+		case s1 >= 0 && s2 < 0, s1 < 0 && d1-d2 >= step:
+			return 8, "falling"
+		case s1 < 0 && (s2 == 0 || d2-d1 >= step):
+			return 6, "falling"
+		}
+		return 7, "falling"
+	}
+}
+
+// The forecasts of the Zambretti forecaster, by letter.
+var zambrettiForecasts = []string{
+	"Settled fine", "Fine weather", "Becoming fine", "Fine, becoming less settled", "Fine, possible showers",
+	"Fairly fine, improving", "Fairly fine, possible showers early", "Fairly fine, showery later",
+	"Showery early, improving", "Changeable, mending", "Fairly fine, showers likely", "Rather unsettled clearing later",
+	"Unsettled, probably improving", "Showery, bright intervals", "Showery, becoming less settled",
+	"Changeable, some rain", "Unsettled, short fine intervals", "Unsettled, rain later", "Unsettled, rain at times",
+	"Very unsettled, finer at times", "Rain at times, worse later", "Rain at times, becoming very unsettled",
+	"Rain at frequent intervals", "Very unsettled, rain", "Stormy, possibly improving", "Stormy, much rain",
+}
+
+// The letters (as offsets from A) each tendency's Zambretti numbers stand for.
+var zambrettiLetters = map[string][]int{
+	"falling": {0, 1, 3, 7, 14, 17, 20, 21, 23},
+	"steady":  {0, 1, 4, 10, 13, 15, 18, 22, 23, 25},
+	"rising":  {0, 1, 2, 5, 6, 8, 9, 11, 12, 16, 19, 24, 25},
+}
+
+// How many hPa the pressure is adjusted by for the wind blowing from each of the 16 compass points.
+// Southerly winds bring worse weather than the barometer alone suggests, northerly ones better.
+var zambrettiWind = []float64{6, 5, 5, 2, -0.5, -2, -5, -8.5, -12, -10, -6, -4.5, -3, -0.5, 1.5, 3}
+
+// zambretti returns the Zambretti forecast, as an offset from A, for a sea level pressure in hPa and
+// its tendency, adjusted for the wind direction (unless it's calm) and the time of year.
+func zambretti(hPa float64, tendency string, windDir int, calm bool, month time.Month) int {
+	if !calm {
+		hPa += zambrettiWind[compassIndex(windDir)]
+	}
+	summer := month >= time.April && month <= time.September
+	switch {
+	case tendency == "rising" && summer:
+		hPa += 7
+	case tendency == "falling" && !summer:
+		hPa -= 7
+	}
+
+	// Each tendency's numbers start where the previous one's end: 1-9, 10-19 and 20-32.
+	var z, first float64
+	switch tendency {
+	case "falling":
+		z, first = 127-0.12*hPa, 1
+	case "steady":
+		z, first = 144-0.13*hPa, 10
+	default:
+		z, first = 185-0.16*hPa, 20
+	}
+	letters := zambrettiLetters[tendency]
+	i := int(math.Floor(z+0.5) - first)
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(letters) {
+		i = len(letters) - 1
+	}
+	return letters[i]
+}
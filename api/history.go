@@ -0,0 +1,353 @@
+package api
+
+import (
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of rows returned by a history request that doesn't specify a limit.
+	defaultHistoryLimit = 500
+
+	// Hard cap on the number of rows in a single page, regardless of what the client asks for.
+	maxHistoryLimit = 2000
+
+	// Hard cap on the number of source rows read for a single downsampled page.
+	maxSampledRows = 10 * maxHistoryLimit
+)
+
+// HistoryPage is one page of a historical range query. NextCursor is nil once the range is exhausted,
+// otherwise it should be passed back as the cursor parameter to fetch the following page.
+type HistoryPage struct {
+	From       time.Time     `json:"from"`
+	To         time.Time     `json:"to"`
+	Count      int           `json:"count"`
+	NextCursor *int          `json:"nextCursor"`
+	Units      Units         `json:"units"`
+	Rows       []interface{} `json:"rows"`
+}
+
+// TenMinHistory handles /api/history/10min?from=...&to=...&fields=...&cursor=...&limit=...&units=...&suspect=...
+// and returns the housestation_10min_all rows in [from, to), ordered by ID.
+func (a *ApiHandlers) TenMinHistory(w http.ResponseWriter, r *http.Request) {
+	q, err := parseRangeParams(r, a.loc)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	units, err := parseUnitsParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	null, err := parseSuspectParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fields, err := parseFieldsParam(r.URL.Query().Get("fields"), TenMinAllRow{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Ask for one row more than the page size, so we know whether there's another page.
+	rows, err := a.store.TenMinRange(RangeQuery{From: q.From, To: q.To, AfterID: q.Cursor, Limit: q.Limit + 1})
+	if err != nil {
+		jww.ERROR.Println(err)
+		writeError(w, http.StatusInternalServerError, "database query failed")
+		return
+	}
+
+	page := HistoryPage{From: q.From, To: q.To, Units: units.Units(), Rows: make([]interface{}, 0)}
+	if len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+		page.NextCursor = &rows[q.Limit-1].ID
+	}
+	for _, t := range a.qcTenMin(rows) {
+		page.Rows = append(page.Rows, tenMinOut(t, units).render(fields, null))
+	}
+
+	page.Count = len(page.Rows)
+	writeJSON(w, http.StatusOK, page)
+}
+
+// FifteenSecHistory handles /api/history/15sec?from=...&to=... and returns the housestation_15sec_wind
+// rows in [from, to). The result can optionally be downsampled on the server, either by keeping every
+// Nth row (every=N, still paged with cursor/limit) or by reducing each interval to its min/avg/max
+// (bucket=5m, which returns WindBuckets and is not paged).
+func (a *ApiHandlers) FifteenSecHistory(w http.ResponseWriter, r *http.Request) {
+	q, err := parseRangeParams(r, a.loc)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	units, err := parseUnitsParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	null, err := parseSuspectParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v := r.URL.Query()
+	if v.Get("every") != "" && v.Get("bucket") != "" {
+		writeError(w, http.StatusBadRequest, "every and bucket can't be used together")
+		return
+	}
+
+	if s := v.Get("bucket"); s != "" {
+		bucket, err := time.ParseDuration(s)
+		if err != nil || bucket < minWindBucket {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid bucket parameter %q, expected a duration of at least %s", s, minWindBucket))
+			return
+		}
+		if q.To.Sub(q.From) > maxWindBucketSpan {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("bucketed queries can span at most %s", maxWindBucketSpan))
+			return
+		}
+		a.writeWindBuckets(w, q, bucket, units)
+		return
+	}
+
+	every := 1
+	if s := v.Get("every"); s != "" {
+		if every, err = strconv.Atoi(s); err != nil || every < 1 || every > maxHistoryLimit {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid every parameter %q", s))
+			return
+		}
+	}
+	if q.Limit*every > maxSampledRows {
+		// Sparser samples come in smaller pages, rather than reading millions of rows at once.
+		q.Limit = maxSampledRows / every
+	}
+
+	// Each page consumes exactly limit*every source rows, so the sampling stays aligned across pages.
+	rows, err := a.store.WindRange(RangeQuery{From: q.From, To: q.To, AfterID: q.Cursor, Limit: q.Limit*every + 1})
+	if err != nil {
+		jww.ERROR.Println(err)
+		writeError(w, http.StatusInternalServerError, "database query failed")
+		return
+	}
+
+	page := HistoryPage{From: q.From, To: q.To, Units: units.Units(), Rows: make([]interface{}, 0)}
+	if len(rows) > q.Limit*every {
+		rows = rows[:q.Limit*every]
+		page.NextCursor = &rows[len(rows)-1].ID
+	}
+	rows = a.qcWind(rows)
+	for i := 0; i < len(rows); i += every {
+		page.Rows = append(page.Rows, windOut(rows[i], units).render(null))
+	}
+
+	page.Count = len(page.Rows)
+	writeJSON(w, http.StatusOK, page)
+}
+
+const (
+	// The smallest bucket that makes sense for data recorded every 15 seconds.
+	minWindBucket = 30 * time.Second
+
+	// Bucketed wind queries are computed in one go rather than paged, so they are limited to
+	// roughly 40,000 source rows.
+	maxWindBucketSpan = 7 * 24 * time.Hour
+)
+
+// WindBucket summarizes the 15 second wind samples recorded in [Start, End).
+type WindBucket struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Count         int       `json:"count"`
+	WindSpeedMin  float64   `json:"WindSpeedMin"`
+	WindSpeedAvg  float64   `json:"WindSpeedAvg"`
+	WindSpeedMax  float64   `json:"WindSpeedMax"`
+	WindDirAvg    int       `json:"WindDirAvg"`
+	WindDirAvgEng string    `json:"WindDirAvgEng"`
+	Excluded      int       `json:"excluded"` // Samples left out for failing QC
+}
+
+// writeWindBuckets reduces the wind samples in the query's range to one WindBucket per interval,
+// with speeds in the given units. Samples that fail QC are left out, so a frozen anemometer's zeros
+// don't drag the minimum and average down, and so are intervals without any samples that passed.
+func (a *ApiHandlers) writeWindBuckets(w http.ResponseWriter, q rangeParams, bucket time.Duration, units UnitSystem) {
+	buckets := make([]interface{}, 0)
+	var cur *WindBucket
+	var sumSpeed, sumSin, sumCos float64
+	qc := newQCState()
+	a.primeWind(qc, q.From)
+
+	flush := func() {
+		if cur == nil || cur.Count == 0 {
+			return
+		}
+		cur.WindSpeedAvg = units.wind(sumSpeed / float64(cur.Count))
+		cur.WindSpeedMin = units.wind(cur.WindSpeedMin)
+		cur.WindSpeedMax = units.wind(cur.WindSpeedMax)
+		cur.WindDirAvg = meanDirection(sumSin, sumCos)
+		cur.WindDirAvgEng = compassPoint(cur.WindDirAvg)
+		buckets = append(buckets, *cur)
+		sumSpeed, sumSin, sumCos = 0, 0, 0
+	}
+
+	cursor := 0
+	for {
+		rows, err := a.store.WindRange(RangeQuery{From: q.From, To: q.To, AfterID: cursor, Limit: maxHistoryLimit})
+		if err != nil {
+			jww.ERROR.Println(err)
+			writeError(w, http.StatusInternalServerError, "database query failed")
+			return
+		}
+
+		for _, f := range rows {
+			f = qc.flagWind(f)
+			start := f.DateTime.Truncate(bucket)
+			if cur == nil || !start.Equal(cur.Start) {
+				flush()
+				cur = &WindBucket{Start: start, End: start.Add(bucket)}
+			}
+			if f.qc.suspect() {
+				cur.Excluded++
+				continue
+			}
+			if cur.Count == 0 {
+				cur.WindSpeedMin, cur.WindSpeedMax = f.WindSpeedCur, f.WindSpeedCur
+			}
+			cur.Count++
+			sumSpeed += f.WindSpeedCur
+			sumSin += math.Sin(float64(f.WindDirCur) * math.Pi / 180)
+			sumCos += math.Cos(float64(f.WindDirCur) * math.Pi / 180)
+			cur.WindSpeedMin = math.Min(cur.WindSpeedMin, f.WindSpeedCur)
+			cur.WindSpeedMax = math.Max(cur.WindSpeedMax, f.WindSpeedCur)
+		}
+
+		if len(rows) < maxHistoryLimit {
+			break
+		}
+		cursor = rows[len(rows)-1].ID
+	}
+	flush()
+
+	writeJSON(w, http.StatusOK, HistoryPage{From: q.From, To: q.To, Count: len(buckets), Units: units.Units(), Rows: buckets})
+}
+
+// rangeParams are the common query parameters of the history endpoints.
+type rangeParams struct {
+	From   time.Time
+	To     time.Time
+	Cursor int
+	Limit  int
+}
+
+// parseRangeParams reads from, to, cursor and limit from the request. from is required; to defaults to now.
+// Times without an explicit offset are taken to be in loc.
+func parseRangeParams(r *http.Request, loc *time.Location) (rangeParams, error) {
+	v := r.URL.Query()
+	p := rangeParams{Limit: defaultHistoryLimit}
+
+	if v.Get("from") == "" {
+		return p, fmt.Errorf("the from parameter is required")
+	}
+	from, err := parseTimeParam(v.Get("from"), loc)
+	if err != nil {
+		return p, fmt.Errorf("invalid from parameter: %s", err)
+	}
+	p.From = from
+
+	p.To = time.Now()
+	if s := v.Get("to"); s != "" {
+		if p.To, err = parseTimeParam(s, loc); err != nil {
+			return p, fmt.Errorf("invalid to parameter: %s", err)
+		}
+	}
+	if !p.To.After(p.From) {
+		return p, fmt.Errorf("to must be after from")
+	}
+
+	if s := v.Get("cursor"); s != "" {
+		if p.Cursor, err = strconv.Atoi(s); err != nil || p.Cursor < 0 {
+			return p, fmt.Errorf("invalid cursor parameter %q", s)
+		}
+	}
+
+	if s := v.Get("limit"); s != "" {
+		if p.Limit, err = strconv.Atoi(s); err != nil || p.Limit < 1 {
+			return p, fmt.Errorf("invalid limit parameter %q", s)
+		}
+	}
+	if p.Limit > maxHistoryLimit {
+		p.Limit = maxHistoryLimit
+	}
+
+	return p, nil
+}
+
+// Accepted layouts for time parameters, in addition to unix seconds.
+var timeParamLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseTimeParam parses a timestamp given in a query string. Layouts without a zone are interpreted
+// in loc, which should be the station's timezone so that "2016-06-01" means midnight at camp.
+func parseTimeParam(s string, loc *time.Location) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).In(loc), nil
+	}
+	for _, layout := range timeParamLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t.In(loc), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a unix timestamp or an RFC 3339 / YYYY-MM-DD date", s)
+}
+
+// parseFieldsParam splits a comma separated list of field names and checks each one exists on the
+// row type. An empty list means "all fields".
+func parseFieldsParam(s string, row interface{}) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	rt := reflect.TypeOf(row)
+	fields := make([]string, 0)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if sf, ok := rt.FieldByName(f); !ok || sf.PkgPath != "" {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// selectFields returns row unchanged if no fields were requested, or else a map holding only the
+// requested fields. ID and DateTime are always included so results can be paged and plotted.
+func selectFields(row interface{}, fields []string) interface{} {
+	if len(fields) == 0 {
+		return row
+	}
+	rv := reflect.ValueOf(row)
+	m := map[string]interface{}{
+		"ID":       rv.FieldByName("ID").Interface(),
+		"DateTime": rv.FieldByName("DateTime").Interface(),
+	}
+	for _, f := range fields {
+		m[f] = rv.FieldByName(f).Interface()
+	}
+	return m
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IngestTenMin accepts a 10 minute reading that was collected directly from the Meteobridge rather
+// than through the database. It's written to the store and published to subscribers straight away.
+// A storage failure is returned, but the reading is still published so live data keeps flowing
+// through a database outage.
+func (a *ApiHandlers) IngestTenMin(t TenMinAllRow) error {
+	err := a.store.InsertTenMin(&t)
+	if err != nil {
+		jww.ERROR.Println("Failed to store ingested 10 minute reading:", err)
+	}
+	a.publish(WSMessage{MsgType: TenMinute, Payload: t})
+	return err
+}
+
+// IngestWind is the 15 second wind equivalent of IngestTenMin.
+func (a *ApiHandlers) IngestWind(f FifteenSecWindMsg) error {
+	err := a.store.InsertWind(&f)
+	if err != nil {
+		jww.ERROR.Println("Failed to store ingested 15 second wind reading:", err)
+	}
+	a.publish(WSMessage{MsgType: FifteenSecWind, Payload: f})
+	return err
+}
+
+// SetIngestTokens replaces the list of tokens accepted by the ingest endpoints. With no tokens, ingestion
+// over HTTP is disabled.
+func (a *ApiHandlers) SetIngestTokens(tokens []string) {
+	a.settingsMu.Lock()
+	a.ingestTokens = append([]string(nil), tokens...)
+	a.settingsMu.Unlock()
+}
+
+// authorizeIngest checks the request carries one of the configured ingest tokens, either as a bearer
+// token or, since a Meteobridge HTTP request event can only set the URL, as a token parameter.
+func (a *ApiHandlers) authorizeIngest(r *http.Request) bool {
+	token := r.FormValue("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		return false
+	}
+
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	ok := false
+	for _, t := range a.ingestTokens {
+		// Check every token in constant time, so response times don't leak anything.
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// IngestTenMinHandler handles /api/ingest/10min, which accepts a reading in the Meteobridge HTTP request
+// event format: the columns of housestation_10min_all as query string or form values (see
+// meteobridge.Template). The reading is stored and published to subscribers immediately.
+func (a *ApiHandlers) IngestTenMinHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.authorizeIngest(r) {
+		writeError(w, http.StatusUnauthorized, "a valid ingest token is required")
+		return
+	}
+
+	t, err := ParseTenMinAllRow(r.Form, a.loc)
+	if err == nil {
+		err = validateTenMin(t)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeIngestResult(w, a.IngestTenMin(t))
+}
+
+// IngestWindHandler handles /api/ingest/15sec, the 15 second wind equivalent of IngestTenMinHandler.
+func (a *ApiHandlers) IngestWindHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !a.authorizeIngest(r) {
+		writeError(w, http.StatusUnauthorized, "a valid ingest token is required")
+		return
+	}
+
+	f, err := ParseFifteenSecWind(r.Form, a.loc)
+	if err == nil {
+		err = validateWind(f)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeIngestResult(w, a.IngestWind(f))
+}
+
+// Readings stamped further in the future than this are rejected, allowing for some clock drift.
+const maxIngestClockSkew = 5 * time.Minute
+
+// validateTenMin rejects readings no station could have produced.
+func validateTenMin(t TenMinAllRow) error {
+	if err := validateDateTime(t.DateTime); err != nil {
+		return err
+	}
+	if t.HumOutCur < 0 || t.HumOutCur > 100 || t.HumInCur < 0 || t.HumInCur > 100 {
+		return fmt.Errorf("humidity must be between 0 and 100")
+	}
+	if t.WindDirCur < 0 || t.WindDirCur > 360 || t.WindDirAvg10 < 0 || t.WindDirAvg10 > 360 {
+		return fmt.Errorf("wind direction must be between 0 and 360")
+	}
+	if t.WindSpeedCur < 0 || t.WindAvgSpeedCur < 0 || t.WindGust10 < 0 {
+		return fmt.Errorf("wind speed can't be negative")
+	}
+	return nil
+}
+
+// validateWind rejects readings no station could have produced.
+func validateWind(f FifteenSecWindMsg) error {
+	if err := validateDateTime(f.DateTime); err != nil {
+		return err
+	}
+	if f.WindDirCur < 0 || f.WindDirCur > 360 {
+		return fmt.Errorf("wind direction must be between 0 and 360")
+	}
+	if f.WindSpeedCur < 0 {
+		return fmt.Errorf("wind speed can't be negative")
+	}
+	return nil
+}
+
+func validateDateTime(dt time.Time) error {
+	if dt.After(time.Now().Add(maxIngestClockSkew)) {
+		return fmt.Errorf("DateTime %s is in the future", dt.Format(meteobridgeTimeLayout))
+	}
+	return nil
+}
+
+// writeIngestResult reports the outcome of storing an ingested reading. A reading that couldn't be
+// stored has still been published, so it's accepted rather than failed.
+func writeIngestResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"stored": false, "error": "the reading was published but could not be stored"})
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"stored": true})
+}
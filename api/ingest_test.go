@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func windValues(speed string) url.Values {
+	return url.Values{
+		"DateTime":      {"2016-06-01 10:20:00"},
+		"WindDirCur":    {"270"},
+		"WindDirCurEng": {"W"},
+		"WindSpeedCur":  {speed},
+	}
+}
+
+func TestParseNonFinite(t *testing.T) {
+	if _, err := ParseFifteenSecWind(windValues("5.4"), time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"NaN", "nan", "Inf", "+Inf", "-Inf", "infinity", "1e400"} {
+		if _, err := ParseFifteenSecWind(windValues(v), time.UTC); err == nil || !strings.Contains(err.Error(), "invalid WindSpeedCur") {
+			t.Errorf("WindSpeedCur=%s: expected an invalid value error, got %v", v, err)
+		}
+	}
+}
+
+func TestIngestRejectsNonFinite(t *testing.T) {
+	s := NewMemoryStore()
+	a := NewApiHandlers(s, time.UTC)
+	a.SetIngestTokens([]string{"secret"})
+
+	v := windValues("NaN")
+	v.Set("token", "secret")
+	w := httptest.NewRecorder()
+	a.IngestWindHandler(w, httptest.NewRequest("POST", "/api/ingest/15sec?"+v.Encode(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d: %s", w.Code, w.Body.String())
+	}
+	if f, _ := s.LatestWind(); f != nil {
+		t.Errorf("a NaN reading was stored: %+v", f)
+	}
+}
@@ -10,19 +10,37 @@ type MsgType string
 const (
 	FifteenSecWind MsgType = "FifteenSecWind"
 	TenMinute              = "TenMinute"
+	Status         MsgType = "Status"
+	Ack            MsgType = "Ack"
+	Forecast       MsgType = "Forecast"
+	Alert          MsgType = "Alert"
 )
 
+// WSMessage is sent to WebSocket clients. ID is the client's position in the stream after this message,
+// see streamCursor; it increases with every new row and can be passed back as ?since= to resume.
 type WSMessage struct {
+	ID      string      `json:"id,omitempty"`
 	MsgType MsgType     `json:"msgType"`
 	Payload interface{} `json:"payload"`
 }
 
+// SourceStatus is the payload of a Status message. It's sent when the monitor loses or regains its
+// connection to the database, so dashboards can warn that what they're showing is stale.
+type SourceStatus struct {
+	Source  string    `json:"source"`
+	Online  bool      `json:"online"`
+	Since   time.Time `json:"since"`
+	Message string    `json:"message"`
+}
+
 type FifteenSecWindMsg struct {
 	ID            int       `json:"ID"`
 	DateTime      time.Time `json:"DateTime"`
 	WindDirCur    int       `json:"WindDirCur"`
 	WindDirCurEng string    `json:"WindDirCurEng"`
 	WindSpeedCur  float64   `json:"WindSpeedCur"`
+
+	qc QCFlags // Set by the QC checks, see qcState
 }
 
 type TenMinAllRow struct {
@@ -52,4 +70,6 @@ type TenMinAllRow struct {
 	RainYest        float64
 	RainMonth       float64
 	RainYear        float64
+
+	qc QCFlags // Set by the QC checks, see qcState
 }
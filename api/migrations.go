@@ -0,0 +1,185 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// A migration is one versioned change to the database schema, with the statements to apply it in each dialect.
+type migration struct {
+	Version int
+	Name    string
+	MySQL   []string
+	SQLite  []string
+	Indexes []migrationIndex // Created after the statements, in either dialect
+}
+
+// migrationIndex is an index on one column. MySQL has no CREATE INDEX IF NOT EXISTS, so an index is
+// only created if the database doesn't have it yet, which lets a partly applied migration be retried.
+type migrationIndex struct {
+	Name   string
+	Table  string
+	Column string
+}
+
+// migrations must only ever be appended to; a deployed database records which versions it has applied.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create housestation tables",
+		// Identical to the README, so existing hand-made tables are left alone.
+		MySQL: []string{
+			"CREATE TABLE IF NOT EXISTS `housestation_10min_all` (" +
+				"`ID` int(11) NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+				"`DateTime` datetime NOT NULL COMMENT 'Date and Time of Readings', " +
+				"`TempOutCur` decimal(4,1) NOT NULL COMMENT 'Current Outdoor Temperature', " +
+				"`HumOutCur` int(11) NOT NULL COMMENT 'Current Outdoor Humidity', " +
+				"`PressCur` decimal(4,2) NOT NULL COMMENT 'Current Barometric Pressure', " +
+				"`DewCur` decimal(4,1) NOT NULL COMMENT 'Current Dew Point', " +
+				"`HeatIdxCur` decimal(4,1) NOT NULL COMMENT 'Current Heat Index', " +
+				"`WindChillCur` decimal(4,1) NOT NULL COMMENT 'Current Wind Chill', " +
+				"`TempInCur` decimal(4,1) NOT NULL COMMENT 'Current Indoor Temperature', " +
+				"`HumInCur` int(11) NOT NULL COMMENT 'Current Indoor Humidity', " +
+				"`WindSpeedCur` decimal(4,1) NOT NULL COMMENT 'Current Wind Speed', " +
+				"`WindAvgSpeedCur` decimal(4,1) NOT NULL COMMENT 'Current Average Wind Speed', " +
+				"`WindDirCur` int(11) NOT NULL COMMENT 'Current Wind Direction (Degrees)', " +
+				"`WindDirCurEng` varchar(3) NOT NULL COMMENT 'Current Wind Direction (English)', " +
+				"`WindGust10` decimal(4,1) NOT NULL COMMENT 'Max Wind Gust for Past 10 Mins', " +
+				"`WindDirAvg10` int(11) NOT NULL COMMENT 'Average Wind Direction (Degrees) for Past 10 Mins', " +
+				"`WindDirAvg10Eng` varchar(3) NOT NULL COMMENT 'Average Wind Direction (English) for Past 10 Mins', " +
+				"`UVAvg10` decimal(6,2) NOT NULL COMMENT 'Average UV Level for past 10 Mins', " +
+				"`UVMax10` decimal(6,2) NOT NULL COMMENT 'Max UV Level for past 10 Mins', " +
+				"`SolarRadAvg10` decimal(6,2) NOT NULL COMMENT 'Average Solar Radiation for past 10 Mins', " +
+				"`SolarRadMax10` decimal(6,2) NOT NULL COMMENT 'Max Solar Radiation for past 10 Mins', " +
+				"`RainRateCur` decimal(5,2) NOT NULL COMMENT 'Current Rain Rate', " +
+				"`RainDay` decimal(4,2) NOT NULL COMMENT 'Total Rain for Today', " +
+				"`RainYest` decimal(4,2) NOT NULL COMMENT 'Total Rain for Yesterday', " +
+				"`RainMonth` decimal(5,2) NOT NULL COMMENT 'Total Rain this Month', " +
+				"`RainYear` decimal(5,2) NOT NULL COMMENT 'Total Rain this Year'" +
+				") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=latin1",
+			"CREATE TABLE IF NOT EXISTS `housestation_15sec_wind` (" +
+				"`ID` int(11) NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+				"`DateTime` datetime NOT NULL COMMENT 'Date and Time of Result', " +
+				"`WindDirCur` int(11) NOT NULL COMMENT 'Wind Direction (Degrees) at this instant', " +
+				"`WindDirCurEng` varchar(3) NOT NULL COMMENT 'Wind Direction (English) at this instant', " +
+				"`WindSpeedCur` decimal(4,1) NOT NULL COMMENT 'Wind Speed at this instant'" +
+				")",
+		},
+		SQLite: []string{
+			`CREATE TABLE IF NOT EXISTS housestation_10min_all (
+				ID INTEGER PRIMARY KEY AUTOINCREMENT,
+				DateTime DATETIME NOT NULL,
+				TempOutCur REAL NOT NULL,
+				HumOutCur INTEGER NOT NULL,
+				PressCur REAL NOT NULL,
+				DewCur REAL NOT NULL,
+				HeatIdxCur REAL NOT NULL,
+				WindChillCur REAL NOT NULL,
+				TempInCur REAL NOT NULL,
+				HumInCur INTEGER NOT NULL,
+				WindSpeedCur REAL NOT NULL,
+				WindAvgSpeedCur REAL NOT NULL,
+				WindDirCur INTEGER NOT NULL,
+				WindDirCurEng TEXT NOT NULL,
+				WindGust10 REAL NOT NULL,
+				WindDirAvg10 INTEGER NOT NULL,
+				WindDirAvg10Eng TEXT NOT NULL,
+				UVAvg10 REAL NOT NULL,
+				UVMax10 REAL NOT NULL,
+				SolarRadAvg10 REAL NOT NULL,
+				SolarRadMax10 REAL NOT NULL,
+				RainRateCur REAL NOT NULL,
+				RainDay REAL NOT NULL,
+				RainYest REAL NOT NULL,
+				RainMonth REAL NOT NULL,
+				RainYear REAL NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS housestation_15sec_wind (
+				ID INTEGER PRIMARY KEY AUTOINCREMENT,
+				DateTime DATETIME NOT NULL,
+				WindDirCur INTEGER NOT NULL,
+				WindDirCurEng TEXT NOT NULL,
+				WindSpeedCur REAL NOT NULL
+			)`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "index DateTime",
+		// The history and aggregate endpoints all select by DateTime.
+		Indexes: []migrationIndex{
+			{Name: "idx_10min_all_datetime", Table: "housestation_10min_all", Column: "DateTime"},
+			{Name: "idx_15sec_wind_datetime", Table: "housestation_15sec_wind", Column: "DateTime"},
+		},
+	},
+}
+
+// Migrator is implemented by stores that can create and upgrade their own schema.
+type Migrator interface {
+	// Migrate applies every migration the database hasn't seen yet, and returns a description of each.
+	Migrate() ([]string, error)
+}
+
+// Migrate brings the database up to the latest schema version. Applied versions are recorded in the
+// weathermoss_migrations table, so it's safe to run repeatedly.
+func (s *sqlStore) Migrate() ([]string, error) {
+	create := "CREATE TABLE IF NOT EXISTS weathermoss_migrations (Version int(11) NOT NULL PRIMARY KEY, Name varchar(255) NOT NULL, AppliedAt datetime NOT NULL)"
+	if s.dialect == dialectSQLite {
+		create = "CREATE TABLE IF NOT EXISTS weathermoss_migrations (Version INTEGER NOT NULL PRIMARY KEY, Name TEXT NOT NULL, AppliedAt DATETIME NOT NULL)"
+	}
+	if _, err := s.db.Exec(create); err != nil {
+		return nil, err
+	}
+
+	var current int
+	if err := s.db.QueryRow("SELECT COALESCE(MAX(Version), 0) FROM weathermoss_migrations").Scan(&current); err != nil {
+		return nil, err
+	}
+
+	applied := make([]string, 0)
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		stmts := m.MySQL
+		if s.dialect == dialectSQLite {
+			stmts = m.SQLite
+		}
+		// MySQL commits DDL implicitly, so a transaction wouldn't help here. A failed migration is simply
+		// not recorded, and will be retried next time once the problem is fixed, so every step of it must
+		// be safe to repeat.
+		for _, stmt := range stmts {
+			if _, err := s.db.Exec(stmt); err != nil {
+				return applied, fmt.Errorf("migration %d (%s) failed: %s", m.Version, m.Name, err)
+			}
+		}
+		for _, ix := range m.Indexes {
+			if err := s.createIndex(ix); err != nil {
+				return applied, fmt.Errorf("migration %d (%s) failed: %s", m.Version, m.Name, err)
+			}
+		}
+		if _, err := s.db.Exec("INSERT INTO weathermoss_migrations (Version, Name, AppliedAt) VALUES (?, ?, ?)", m.Version, m.Name, s.timeArg(time.Now())); err != nil {
+			return applied, err
+		}
+		applied = append(applied, fmt.Sprintf("%d: %s", m.Version, m.Name))
+	}
+
+	return applied, nil
+}
+
+// createIndex creates ix, unless it already exists.
+func (s *sqlStore) createIndex(ix migrationIndex) error {
+	if s.dialect == dialectSQLite {
+		_, err := s.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", ix.Name, ix.Table, ix.Column))
+		return err
+	}
+
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?", ix.Table, ix.Name).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = s.db.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", ix.Name, ix.Table, ix.Column))
+	return err
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a subscriber can't keep up, and its buffer is full.
+type OverflowPolicy string
+
+const (
+	// DropOldest discards the oldest buffered message to make room for the new one. The readings it
+	// discards are read back from storage before the client is sent anything newer; see fillGap.
+	DropOldest OverflowPolicy = "drop-oldest"
+	// Coalesce reduces the buffer to the newest message of each MsgType. Good for dashboards, which
+	// only show the latest reading anyway. The readings it skips are never sent, even on resuming.
+	Coalesce OverflowPolicy = "coalesce"
+	// Disconnect closes the connection, so the client can reconnect with ?since= and be replayed
+	// everything it missed from storage.
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+// MinSubscriberBuffer is the smallest buffer a subscriber can have: room for one message of each type
+// the monitor streams, which Coalesce needs.
+const MinSubscriberBuffer = 5
+
+// ParseOverflowPolicy checks s names a policy. An empty string is the default, DropOldest.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case "":
+		return DropOldest, nil
+	case DropOldest, Coalesce, Disconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q, expected drop-oldest, coalesce or disconnect", s)
+	}
+}
+
+// SetOverflowPolicy sets the policy of clients that don't choose one with ?overflow=.
+func (a *ApiHandlers) SetOverflowPolicy(p OverflowPolicy) {
+	a.settingsMu.Lock()
+	a.overflowPolicy = p
+	a.settingsMu.Unlock()
+}
+
+// overflowPolicyParam returns the policy requested with ?overflow=, or else the configured one.
+func (a *ApiHandlers) overflowPolicyParam(r *http.Request) (OverflowPolicy, error) {
+	if s := r.URL.Query().Get("overflow"); s != "" {
+		return ParseOverflowPolicy(s)
+	}
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return ParseOverflowPolicy(string(a.overflowPolicy))
+}
+
+// offer queues msg for the subscriber, applying its overflow policy if the buffer is full. It must only
+// be called from runMonitor, which makes it the only goroutine sending to bufChan.
+func (s *subscriber) offer(msg WSMessage) {
+	select {
+	case s.bufChan <- msg:
+		return
+	default:
+	}
+
+	if atomic.LoadUint64(&s.dropped) == 0 {
+		jww.WARN.Println("Subscriber", s.id, "("+s.name+", "+s.remote+") can't keep up, applying the", s.policy, "policy.")
+	}
+
+	switch s.policy {
+	case Disconnect:
+		atomic.AddUint64(&s.dropped, 1)
+		if !s.overflowed {
+			s.overflowed = true
+			close(s.slow)
+		}
+	case Coalesce:
+		pending := []WSMessage{}
+		for len(s.bufChan) > 0 {
+			select {
+			case m := <-s.bufChan:
+				pending = append(pending, m)
+			default:
+			}
+		}
+		pending = append(pending, msg)
+
+		// Keep the newest message of each type, in the order they were queued. The monitor mustn't block
+		// here, so anything that still doesn't fit is dropped too.
+		keep := make(map[MsgType]int)
+		for i, m := range pending {
+			keep[m.MsgType] = i
+		}
+		kept := 0
+		for i, m := range pending {
+			if keep[m.MsgType] != i {
+				continue
+			}
+			select {
+			case s.bufChan <- m:
+				kept++
+			default:
+			}
+		}
+		atomic.AddUint64(&s.dropped, uint64(len(pending)-kept))
+	default:
+		select {
+		case <-s.bufChan:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+			// The writer got there first
+		}
+		select {
+		case s.bufChan <- msg:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// SubscriberStats describes one connected WebSocket or event stream client.
+type SubscriberStats struct {
+	ID        int            `json:"id"`
+	Feed      string         `json:"feed"`
+	Policy    OverflowPolicy `json:"policy"`
+	Connected time.Time      `json:"connected"`
+	Buffered  int            `json:"buffered"`
+	Dropped   uint64         `json:"dropped"`
+}
+
+// Subscribers handles /api/subscribers, and lists the connected clients along with how many messages
+// each has had dropped for not keeping up.
+func (a *ApiHandlers) Subscribers(w http.ResponseWriter, r *http.Request) {
+	res := make([]SubscriberStats, 0)
+	a.monitor.RLock()
+	for _, s := range a.monitor.subscribers {
+		res = append(res, SubscriberStats{
+			ID:        s.id,
+			Feed:      s.name,
+			Policy:    s.policy,
+			Connected: s.connected,
+			Buffered:  len(s.bufChan),
+			Dropped:   atomic.LoadUint64(&s.dropped),
+		})
+	}
+	a.monitor.RUnlock()
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,279 @@
+package api
+
+import (
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"math"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// QC flags, naming the first check a reading failed.
+const (
+	QCOK          = "ok"
+	QCRange       = "range"       // Outside what the sensor can believably report
+	QCStep        = "step"        // Jumped further from the previous reading than the weather can
+	QCPersistence = "persistence" // Stuck at exactly the same value for too long
+	QCConsistency = "consistency" // Contradicts another reading, e.g. a dew point above the temperature
+)
+
+// QCFlags holds the QC flag of each checked reading of a row, by field name.
+type QCFlags map[string]string
+
+// suspect reports whether any reading failed QC.
+func (q QCFlags) suspect() bool {
+	for _, flag := range q {
+		if flag != QCOK {
+			return true
+		}
+	}
+	return false
+}
+
+// null replaces the suspect readings in a row rendered as a map with nil.
+func (q QCFlags) null(m map[string]interface{}) {
+	for f, flag := range q {
+		if _, ok := m[f]; ok && flag != QCOK {
+			m[f] = nil
+		}
+	}
+}
+
+// qcFlag returns the QC flag of a reading in a row. Readings that aren't checked are taken to be ok.
+func qcFlag(row interface{}, field string) string {
+	var q QCFlags
+	switch p := row.(type) {
+	case TenMinAllRow:
+		q = p.qc
+	case FifteenSecWindMsg:
+		q = p.qc
+	}
+	if flag, ok := q[field]; ok {
+		return flag
+	}
+	return QCOK
+}
+
+// qcLimits are the checks made on one field, in the units it's stored in.
+type qcLimits struct {
+	min, max float64
+	step     float64       // The largest believable change between consecutive readings, 0 for no step test
+	persist  time.Duration // The longest a reading can stay exactly the same, 0 for no persistence test
+}
+
+// How far back the checks are primed: the longest persist time, plus the longest gap the step test is
+// made across, so a run of equal readings that started earlier is still long enough to be flagged.
+const qcLookback = 6*time.Hour + 3*tenMinCadence
+
+var tenMinLimits = map[string]qcLimits{
+	"TempOutCur":      {min: -60, max: 130, step: 15, persist: 3 * time.Hour},
+	"HumOutCur":       {min: 1, max: 100, step: 30},
+	"PressCur":        {min: 27, max: 32, step: 0.1, persist: 6 * time.Hour},
+	"DewCur":          {min: -80, max: 100, step: 15},
+	"HeatIdxCur":      {min: -80, max: 180},
+	"WindChillCur":    {min: -120, max: 130},
+	"TempInCur":       {min: 20, max: 120},
+	"HumInCur":        {min: 1, max: 100},
+	"WindSpeedCur":    {min: 0, max: 200, persist: 6 * time.Hour},
+	"WindAvgSpeedCur": {min: 0, max: 200, persist: 6 * time.Hour},
+	"WindDirCur":      {min: 0, max: 360},
+	"WindGust10":      {min: 0, max: 200, persist: 6 * time.Hour},
+	"WindDirAvg10":    {min: 0, max: 360},
+	"UVAvg10":         {min: 0, max: 20},
+	"UVMax10":         {min: 0, max: 20},
+	"SolarRadAvg10":   {min: 0, max: 1800},
+	"SolarRadMax10":   {min: 0, max: 1800},
+	"RainRateCur":     {min: 0, max: 30},
+	"RainDay":         {min: 0, max: 30},
+}
+
+var windLimits = map[string]qcLimits{
+	"WindSpeedCur": {min: 0, max: 200, persist: 6 * time.Hour},
+	"WindDirCur":   {min: 0, max: 360},
+}
+
+// qcField is where the step and persistence tests of one field have got to.
+type qcField struct {
+	last    float64 // The last reading that passed the step test
+	lastAt  time.Time
+	run     float64 // The value the field has been stuck at since runFrom
+	runFrom time.Time
+}
+
+// check returns the QC flag of reading v, taken at at. A reading that fails the step test isn't used
+// for the next one, so a spike is flagged without its return to normal being flagged too. If the
+// readings stay at a new level for longer than gap, it's accepted.
+func (f *qcField) check(v float64, at time.Time, l qcLimits, gap time.Duration) string {
+	if v < l.min || v > l.max {
+		return QCRange
+	}
+
+	flag := QCOK
+	if l.step > 0 {
+		if !f.lastAt.IsZero() && at.Sub(f.lastAt) <= gap && math.Abs(v-f.last) > l.step {
+			flag = QCStep
+		} else {
+			f.last, f.lastAt = v, at
+		}
+	}
+	if l.persist > 0 {
+		if f.runFrom.IsZero() || v != f.run {
+			f.run, f.runFrom = v, at
+		} else if at.Sub(f.runFrom) >= l.persist && flag == QCOK {
+			flag = QCPersistence
+		}
+	}
+	return flag
+}
+
+// qcChecker runs the QC checks over the rows of one table, which must be given to it oldest first.
+type qcChecker struct {
+	limits map[string]qcLimits
+	gap    time.Duration // The longest gap between readings the step test is made across
+	fields map[string]*qcField
+}
+
+func newQCChecker(limits map[string]qcLimits, cadence time.Duration) *qcChecker {
+	c := &qcChecker{limits: limits, gap: 3 * cadence, fields: make(map[string]*qcField)}
+	for name := range limits {
+		c.fields[name] = &qcField{}
+	}
+	return c
+}
+
+// check flags each of the row's readings.
+func (c *qcChecker) check(row interface{}, at time.Time) QCFlags {
+	rv := reflect.ValueOf(row)
+	flags := make(QCFlags, len(c.limits))
+	for name, l := range c.limits {
+		f := rv.FieldByName(name)
+		v := float64(0)
+		if f.Kind() == reflect.Int {
+			v = float64(f.Int())
+		} else {
+			v = f.Float()
+		}
+		flags[name] = c.fields[name].check(v, at, l, c.gap)
+	}
+	return flags
+}
+
+// consistent flags fields as inconsistent unless ok, leaving any that already failed a check alone.
+func (q QCFlags) consistent(ok bool, fields ...string) {
+	if ok {
+		return
+	}
+	for _, f := range fields {
+		if q[f] == QCOK {
+			q[f] = QCConsistency
+		}
+	}
+}
+
+// qcState runs QC over the rows of both tables.
+type qcState struct {
+	tenMin *qcChecker
+	wind   *qcChecker
+}
+
+func newQCState() *qcState {
+	return &qcState{
+		tenMin: newQCChecker(tenMinLimits, tenMinCadence),
+		wind:   newQCChecker(windLimits, fifteenSecCadence),
+	}
+}
+
+// flagTenMin returns t with its QC flags. The dew point can't be above the temperature (allowing for
+// rounding), and the average wind can't be above the gust.
+func (q *qcState) flagTenMin(t TenMinAllRow) TenMinAllRow {
+	t.qc = q.tenMin.check(t, t.DateTime)
+	t.qc.consistent(t.DewCur <= t.TempOutCur+1, "DewCur", "TempOutCur")
+	t.qc.consistent(t.WindAvgSpeedCur <= t.WindGust10+1, "WindAvgSpeedCur", "WindGust10")
+	return t
+}
+
+// flagWind returns f with its QC flags.
+func (q *qcState) flagWind(f FifteenSecWindMsg) FifteenSecWindMsg {
+	f.qc = q.wind.check(f, f.DateTime)
+	return f
+}
+
+// primeTenMin runs q's checks over the 10 minute rows recorded in the qcLookback before at, so they
+// have the recent history to compare the next readings with.
+func (a *ApiHandlers) primeTenMin(q *qcState, at time.Time) {
+	rows, err := a.store.TenMinRange(RangeQuery{From: at.Add(-qcLookback), To: at, Limit: maxHistoryLimit})
+	if err != nil {
+		jww.ERROR.Println(err)
+	}
+	for _, t := range rows {
+		q.flagTenMin(t)
+	}
+}
+
+// primeWind is primeTenMin for the 15 second table.
+func (a *ApiHandlers) primeWind(q *qcState, at time.Time) {
+	rows, err := a.store.WindRange(RangeQuery{From: at.Add(-qcLookback), To: at, Limit: maxHistoryLimit})
+	if err != nil {
+		jww.ERROR.Println(err)
+	}
+	for _, f := range rows {
+		q.flagWind(f)
+	}
+}
+
+// qcTenMin flags rows read from the store, oldest first. The checks are primed with the rows recorded
+// shortly before them, so they flag the same readings they did when the rows were new.
+func (a *ApiHandlers) qcTenMin(rows []TenMinAllRow) []TenMinAllRow {
+	if len(rows) == 0 {
+		return rows
+	}
+	q := newQCState()
+	a.primeTenMin(q, rows[0].DateTime)
+
+	res := make([]TenMinAllRow, len(rows))
+	for i, t := range rows {
+		res[i] = q.flagTenMin(t)
+	}
+	return res
+}
+
+// qcWind is qcTenMin for the 15 second table.
+func (a *ApiHandlers) qcWind(rows []FifteenSecWindMsg) []FifteenSecWindMsg {
+	if len(rows) == 0 {
+		return rows
+	}
+	q := newQCState()
+	a.primeWind(q, rows[0].DateTime)
+
+	res := make([]FifteenSecWindMsg, len(rows))
+	for i, f := range rows {
+		res[i] = q.flagWind(f)
+	}
+	return res
+}
+
+// parseSuspectParam reads the suspect query parameter: "keep" (the default) sends readings that failed
+// QC as they are, and "null" replaces them with null.
+func parseSuspectParam(r *http.Request) (bool, error) {
+	switch s := r.URL.Query().Get("suspect"); s {
+	case "", "keep":
+		return false, nil
+	case "null":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid suspect parameter %q, expected keep or null", s)
+	}
+}
+
+// rowMap returns every reading of row in a map, for rendering with some of them replaced.
+func rowMap(row interface{}) map[string]interface{} {
+	rv := reflect.ValueOf(row)
+	m := make(map[string]interface{}, rv.NumField())
+	for i := 0; i < rv.NumField(); i++ {
+		if f := rv.Type().Field(i); f.PkgPath == "" {
+			m[f.Name] = rv.Field(i).Interface()
+		}
+	}
+	return m
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"regexp"
+	"strings"
+)
+
+// columnDef is a column of one of the tables documented in the README. Type is the MySQL COLUMN_TYPE.
+type columnDef struct {
+	Name string
+	Type string
+}
+
+// The housestation_10min_all table, in the order scanTenMinAllRow reads it.
+var tenMinAllColumns = []columnDef{
+	{"ID", "int(11)"},
+	{"DateTime", "datetime"},
+	{"TempOutCur", "decimal(4,1)"},
+	{"HumOutCur", "int(11)"},
+	{"PressCur", "decimal(4,2)"},
+	{"DewCur", "decimal(4,1)"},
+	{"HeatIdxCur", "decimal(4,1)"},
+	{"WindChillCur", "decimal(4,1)"},
+	{"TempInCur", "decimal(4,1)"},
+	{"HumInCur", "int(11)"},
+	{"WindSpeedCur", "decimal(4,1)"},
+	{"WindAvgSpeedCur", "decimal(4,1)"},
+	{"WindDirCur", "int(11)"},
+	{"WindDirCurEng", "varchar(3)"},
+	{"WindGust10", "decimal(4,1)"},
+	{"WindDirAvg10", "int(11)"},
+	{"WindDirAvg10Eng", "varchar(3)"},
+	{"UVAvg10", "decimal(6,2)"},
+	{"UVMax10", "decimal(6,2)"},
+	{"SolarRadAvg10", "decimal(6,2)"},
+	{"SolarRadMax10", "decimal(6,2)"},
+	{"RainRateCur", "decimal(5,2)"},
+	{"RainDay", "decimal(4,2)"},
+	{"RainYest", "decimal(4,2)"},
+	{"RainMonth", "decimal(5,2)"},
+	{"RainYear", "decimal(5,2)"},
+}
+
+// The housestation_15sec_wind table, in the order scanFifteenSecWind reads it.
+var fifteenSecWindColumns = []columnDef{
+	{"ID", "int(11)"},
+	{"DateTime", "datetime"},
+	{"WindDirCur", "int(11)"},
+	{"WindDirCurEng", "varchar(3)"},
+	{"WindSpeedCur", "decimal(4,1)"},
+}
+
+var (
+	tenMinAllColumnList      = columnList(tenMinAllColumns)
+	fifteenSecWindColumnList = columnList(fifteenSecWindColumns)
+)
+
+// columnList joins the column names for use in a SELECT.
+func columnList(cols []columnDef) string {
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// SchemaValidator is implemented by stores that can check the database they're reading from matches
+// the schema WeatherMoss expects.
+type SchemaValidator interface {
+	ValidateSchema() error
+}
+
+// SchemaError lists every difference found between the expected and actual tables.
+type SchemaError struct {
+	Diffs []string
+}
+
+func (e *SchemaError) Error() string {
+	var b bytes.Buffer
+	b.WriteString("database schema doesn't match the one documented in the README:")
+	for _, d := range e.Diffs {
+		b.WriteString("\n  ")
+		b.WriteString(d)
+	}
+	return b.String()
+}
+
+// MySQL 8 no longer reports display widths for integer types, so "int(11)" and "int" are the same thing.
+var intDisplayWidth = regexp.MustCompile(`^((?:tiny|small|medium|big)?int)\(\d+\)`)
+
+func normalizeColumnType(t string) string {
+	return intDisplayWidth.ReplaceAllString(strings.ToLower(strings.TrimSpace(t)), "$1")
+}
+
+// ValidateSchema compares the housestation_* tables against information_schema. Missing columns and
+// columns of the wrong type are errors, since they'd break scanning or silently change values. Extra
+// columns are only logged, because everything is selected by name.
+func (s *sqlStore) ValidateSchema() error {
+	if s.dialect != dialectMySQL {
+		// The other dialects create their own tables, so there's nothing to drift from.
+		return nil
+	}
+
+	tables := map[string][]columnDef{
+		"housestation_10min_all":  tenMinAllColumns,
+		"housestation_15sec_wind": fifteenSecWindColumns,
+	}
+	diffs := make([]string, 0)
+	for _, table := range []string{"housestation_10min_all", "housestation_15sec_wind"} {
+		actual, err := s.columnTypes(table)
+		if err != nil {
+			return err
+		}
+		diffs = append(diffs, diffColumns(table, tables[table], actual)...)
+	}
+
+	if len(diffs) > 0 {
+		return &SchemaError{Diffs: diffs}
+	}
+	return nil
+}
+
+// columnTypes returns the COLUMN_TYPE of every column in table, keyed by column name.
+func (s *sqlStore) columnTypes(table string) (map[string]string, error) {
+	rows, err := s.db.Query("SELECT COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		res[name] = typ
+	}
+	return res, rows.Err()
+}
+
+// diffColumns describes how the actual columns of table differ from the expected ones.
+func diffColumns(table string, expected []columnDef, actual map[string]string) []string {
+	if len(actual) == 0 {
+		return []string{fmt.Sprintf("table %s does not exist", table)}
+	}
+
+	diffs := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, c := range expected {
+		seen[c.Name] = true
+		typ, ok := actual[c.Name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("- %s.%s %s (missing)", table, c.Name, c.Type))
+			continue
+		}
+		if normalizeColumnType(typ) != normalizeColumnType(c.Type) {
+			diffs = append(diffs, fmt.Sprintf("~ %s.%s is %s, expected %s", table, c.Name, typ, c.Type))
+		}
+	}
+	for name, typ := range actual {
+		if !seen[name] {
+			jww.WARN.Printf("Ignoring unexpected column %s.%s %s", table, name, typ)
+		}
+	}
+	return diffs
+}
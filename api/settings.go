@@ -0,0 +1,46 @@
+package api
+
+import (
+	"time"
+)
+
+// SetPollPeriod sets how often the monitor checks whether a table is due to be polled, which is also
+// the fastest any table is polled. It takes effect at the next tick.
+func (a *ApiHandlers) SetPollPeriod(d time.Duration) {
+	a.settingsMu.Lock()
+	a.pollPeriod = d
+	a.settingsMu.Unlock()
+}
+
+// SetBackfillSize sets how many rows of each table new WebSocket and event stream clients are sent.
+func (a *ApiHandlers) SetBackfillSize(n int) {
+	a.settingsMu.Lock()
+	a.backfillSize = n
+	a.settingsMu.Unlock()
+}
+
+// SetSubscriberBuffer sets how many messages can wait for a slow client before its overflow policy
+// applies. It only affects clients that connect afterwards.
+func (a *ApiHandlers) SetSubscriberBuffer(n int) {
+	a.settingsMu.Lock()
+	a.subscriberBuffer = n
+	a.settingsMu.Unlock()
+}
+
+func (a *ApiHandlers) getPollPeriod() time.Duration {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.pollPeriod
+}
+
+func (a *ApiHandlers) getBackfillSize() int {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.backfillSize
+}
+
+func (a *ApiHandlers) getSubscriberBuffer() int {
+	a.settingsMu.RLock()
+	defer a.settingsMu.RUnlock()
+	return a.subscriberBuffer
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// Shutdown stops the monitor, and closes every WebSocket with a "going away" close frame and every event
+// stream, so clients know to reconnect. It waits for them to finish, and for the alerts already queued
+// to be sent to the webhook, until ctx is done. New streams are refused from then on, and ingested
+// readings are stored but no longer published.
+func (a *ApiHandlers) Shutdown(ctx context.Context) error {
+	a.streamsMu.Lock()
+	a.stop()
+	a.streamsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.streams.Wait()
+		<-a.monitorDone
+		<-a.webhooksDone
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		jww.INFO.Println("Closed all live feeds and stopped the monitor.")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// beginStream registers a WebSocket or event stream that Shutdown must wait for. It returns false if
+// the server is already shutting down, in which case the stream shouldn't be started.
+func (a *ApiHandlers) beginStream() bool {
+	a.streamsMu.Lock()
+	defer a.streamsMu.Unlock()
+	select {
+	case <-a.stopping:
+		return false
+	default:
+	}
+	a.streams.Add(1)
+	return true
+}
+
+// endStream is called when a stream registered with beginStream has been closed.
+func (a *ApiHandlers) endStream() {
+	a.streams.Done()
+}
+
+// publish hands a reading that didn't come from the database to the monitor, unless it has stopped.
+func (a *ApiHandlers) publish(msg WSMessage) {
+	select {
+	case a.monitor.incoming <- msg:
+	case <-a.stopping:
+	}
+}
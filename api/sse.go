@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"time"
+)
+
+// SseCombinedHandler streams every message type as server-sent events, for clients that can't use
+// WebSockets.
+func (a *ApiHandlers) SseCombinedHandler(w http.ResponseWriter, r *http.Request) {
+	a.serveEvents(w, r, "combined", FifteenSecWind, TenMinute, Status, Forecast, Alert)
+}
+
+// SseFifteenSecHandler streams only FifteenSecWind messages as server-sent events.
+func (a *ApiHandlers) SseFifteenSecHandler(w http.ResponseWriter, r *http.Request) {
+	a.serveEvents(w, r, "15Sec", FifteenSecWind)
+}
+
+// SseTenMinuteHandler streams only TenMinute messages as server-sent events.
+func (a *ApiHandlers) SseTenMinuteHandler(w http.ResponseWriter, r *http.Request) {
+	a.serveEvents(w, r, "10Minute", TenMinute)
+}
+
+// serveEvents sends the same stream of messages as the WebSocket writer, as a text/event-stream.
+// Each event is named after its MsgType, and has the message's stream ID as its event ID, so the
+// browser's EventSource resumes where it left off by itself, with the Last-Event-ID header.
+func (a *ApiHandlers) serveEvents(w http.ResponseWriter, r *http.Request, name string, types ...MsgType) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming isn't supported")
+		return
+	}
+
+	// EventSource can't set headers when it first connects, so ?since= works too.
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("since")
+	}
+	since, err := parseStreamCursor(last)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	policy, err := a.overflowPolicyParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	units, err := parseUnitsParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	null, err := parseSuspectParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !a.beginStream() {
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	defer a.endStream()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx holding back events
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The subscription ends when the client goes away, or when this returns.
+	ctx, cancel := context.WithCancel(r.Context())
+	c := newWSClient(name, a.getDBSubscriber(ctx, name+" events", r.RemoteAddr, policy), true, types...)
+	c.units, c.null = units, null
+	pingTicker := time.NewTicker(pingPeriod)
+	jww.INFO.Println("Opened", c.name, "event stream.")
+	defer func() {
+		jww.INFO.Println("Closing", c.name, "event stream.")
+		cancel()
+		close(c.done)
+		pingTicker.Stop()
+	}()
+
+	out := sseSink{w: w, flusher: flusher}
+	if err := a.catchUp(out, c, since); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case msg := <-c.sub.bufChan:
+			if err := a.fillGap(out, c); err != nil {
+				return
+			}
+			if c.sent.covers(msg) {
+				// Already sent while catching up
+				continue
+			}
+			if err := c.send(out, msg); err != nil {
+				return
+			}
+		case <-a.stopping:
+			return
+		case <-c.sub.slow:
+			// Disconnected by the overflow policy. EventSource reconnects with Last-Event-ID by itself.
+			return
+		case <-pingTicker.C:
+			// A comment line, to keep proxies from timing out an idle connection.
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// sseSink writes messages to an event stream.
+type sseSink struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s sseSink) writeMessage(msg WSMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "id: %s\nevent: %s\ndata: %s\n\n", msg.ID, msg.MsgType, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
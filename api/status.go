@@ -0,0 +1,61 @@
+package api
+
+import (
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+)
+
+// The longest the monitor waits between attempts to reach an unavailable database.
+const maxRetryBackoff = 1 * time.Minute
+
+// sourceFailed is called by runMonitor when polling the database fails. The first failure tells
+// subscribers their data is going stale; after that the monitor retries with an exponential backoff.
+// database/sql reconnects by itself, so retrying the queries is all that's needed to recover.
+func (a *ApiHandlers) sourceFailed(err error) {
+	m := a.monitor
+	now := time.Now()
+
+	if m.status.Online {
+		m.retryBackoff = a.getPollPeriod()
+		a.setStatus(SourceStatus{
+			Source:  "database",
+			Online:  false,
+			Since:   now,
+			Message: fmt.Sprintf("source offline since %s", now.Format(time.RFC3339)),
+		})
+		jww.ERROR.Println("Database unavailable, live updates have stopped:", err)
+	} else {
+		m.retryBackoff *= 2
+		if m.retryBackoff > maxRetryBackoff {
+			m.retryBackoff = maxRetryBackoff
+		}
+		jww.WARN.Println("Database still unavailable, retrying in", m.retryBackoff, "Error was:", err)
+	}
+	m.retryAt = now.Add(m.retryBackoff)
+}
+
+// sourceRecovered is called by runMonitor after every successful poll.
+func (a *ApiHandlers) sourceRecovered() {
+	if a.monitor.status.Online {
+		return
+	}
+
+	offline := time.Since(a.monitor.status.Since)
+	a.monitor.retryAt = time.Time{}
+	a.setStatus(SourceStatus{
+		Source:  "database",
+		Online:  true,
+		Since:   time.Now(),
+		Message: "recovered",
+	})
+	jww.WARN.Println("Database available again after", offline)
+}
+
+// setStatus records the new status and tells every subscriber about it.
+func (a *ApiHandlers) setStatus(st SourceStatus) {
+	a.monitor.Lock()
+	a.monitor.status = st
+	a.monitor.Unlock()
+	a.notifySubscribers([]WSMessage{{MsgType: Status, Payload: st}})
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"time"
+)
+
+// Store is where the API reads the station's readings from (and, for stores that are fed by
+// WeatherMoss itself rather than by the Meteobridge, writes them to).
+//
+// Rows are always returned in ascending ID order, and IDs are assumed to increase with DateTime.
+type Store interface {
+	// LatestWind returns the most recent 15 second wind row, or nil if the table is empty.
+	LatestWind() (*FifteenSecWindMsg, error)
+	// LatestTenMin returns the most recent 10 minute row, or nil if the table is empty.
+	LatestTenMin() (*TenMinAllRow, error)
+
+	// RecentWind returns the last n 15 second wind rows.
+	RecentWind(n int) ([]FifteenSecWindMsg, error)
+	// RecentTenMin returns the last n 10 minute rows.
+	RecentTenMin(n int) ([]TenMinAllRow, error)
+
+	// WindRange returns the 15 second wind rows matching q.
+	WindRange(q RangeQuery) ([]FifteenSecWindMsg, error)
+	// TenMinRange returns the 10 minute rows matching q.
+	TenMinRange(q RangeQuery) ([]TenMinAllRow, error)
+
+	// InsertWind stores f and sets its ID.
+	InsertWind(f *FifteenSecWindMsg) error
+	// InsertTenMin stores t and sets its ID.
+	InsertTenMin(t *TenMinAllRow) error
+
+	Close() error
+}
+
+// RangeQuery selects rows with From <= DateTime < To and ID > AfterID. A zero From or To leaves that
+// end of the range open. At most Limit rows are returned.
+type RangeQuery struct {
+	From    time.Time
+	To      time.Time
+	AfterID int
+	Limit   int
+}
+
+// matches reports whether a row with the given ID and DateTime falls within the query's bounds.
+func (q RangeQuery) matches(id int, dt time.Time) bool {
+	if id <= q.AfterID {
+		return false
+	}
+	if !q.From.IsZero() && dt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !dt.Before(q.To) {
+		return false
+	}
+	return true
+}
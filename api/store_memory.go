@@ -0,0 +1,115 @@
+package api
+
+import (
+	"sync"
+)
+
+// MemoryStore is a Store that keeps everything in memory. It's meant for local development and
+// tests, where there's no Meteobridge-fed database to point at. Nothing is persisted.
+type MemoryStore struct {
+	wind   []FifteenSecWindMsg
+	tenMin []TenMinAllRow
+	sync.RWMutex
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		wind:   make([]FifteenSecWindMsg, 0),
+		tenMin: make([]TenMinAllRow, 0),
+	}
+}
+
+func (m *MemoryStore) LatestWind() (*FifteenSecWindMsg, error) {
+	m.RLock()
+	defer m.RUnlock()
+	if len(m.wind) == 0 {
+		return nil, nil
+	}
+	f := m.wind[len(m.wind)-1]
+	return &f, nil
+}
+
+func (m *MemoryStore) LatestTenMin() (*TenMinAllRow, error) {
+	m.RLock()
+	defer m.RUnlock()
+	if len(m.tenMin) == 0 {
+		return nil, nil
+	}
+	t := m.tenMin[len(m.tenMin)-1]
+	return &t, nil
+}
+
+func (m *MemoryStore) RecentWind(n int) ([]FifteenSecWindMsg, error) {
+	m.RLock()
+	defer m.RUnlock()
+	if n < 0 {
+		n = 0
+	}
+	if n > len(m.wind) {
+		n = len(m.wind)
+	}
+	return append([]FifteenSecWindMsg(nil), m.wind[len(m.wind)-n:]...), nil
+}
+
+func (m *MemoryStore) RecentTenMin(n int) ([]TenMinAllRow, error) {
+	m.RLock()
+	defer m.RUnlock()
+	if n < 0 {
+		n = 0
+	}
+	if n > len(m.tenMin) {
+		n = len(m.tenMin)
+	}
+	return append([]TenMinAllRow(nil), m.tenMin[len(m.tenMin)-n:]...), nil
+}
+
+func (m *MemoryStore) WindRange(q RangeQuery) ([]FifteenSecWindMsg, error) {
+	m.RLock()
+	defer m.RUnlock()
+	res := make([]FifteenSecWindMsg, 0)
+	for _, f := range m.wind {
+		if len(res) == q.Limit {
+			break
+		}
+		if q.matches(f.ID, f.DateTime) {
+			res = append(res, f)
+		}
+	}
+	return res, nil
+}
+
+func (m *MemoryStore) TenMinRange(q RangeQuery) ([]TenMinAllRow, error) {
+	m.RLock()
+	defer m.RUnlock()
+	res := make([]TenMinAllRow, 0)
+	for _, t := range m.tenMin {
+		if len(res) == q.Limit {
+			break
+		}
+		if q.matches(t.ID, t.DateTime) {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+func (m *MemoryStore) InsertWind(f *FifteenSecWindMsg) error {
+	m.Lock()
+	defer m.Unlock()
+	f.ID = len(m.wind) + 1
+	m.wind = append(m.wind, *f)
+	return nil
+}
+
+func (m *MemoryStore) InsertTenMin(t *TenMinAllRow) error {
+	m.Lock()
+	defer m.Unlock()
+	t.ID = len(m.tenMin) + 1
+	m.tenMin = append(m.tenMin, *t)
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"database/sql"
+	_ "github.com/go-sql-driver/mysql"
+	"strings"
+	"time"
+)
+
+// SQL dialects understood by sqlStore.
+const (
+	dialectMySQL  = "mysql"
+	dialectSQLite = "sqlite"
+)
+
+// sqlStore is a Store backed by the housestation_* tables in a SQL database.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// NewMySQLStore returns a Store reading from the tables the Meteobridge logs into. The DSN d was
+// opened with must set parseTime=true.
+func NewMySQLStore(d *sql.DB) Store {
+	return &sqlStore{db: d, dialect: dialectMySQL}
+}
+
+// timeArg prepares a time to be used as a query argument. SQLite stores DATETIMEs as text, so all times
+// are normalized to UTC to keep comparisons between them meaningful.
+func (s *sqlStore) timeArg(t time.Time) time.Time {
+	if s.dialect == dialectSQLite {
+		return t.UTC()
+	}
+	return t
+}
+
+func (s *sqlStore) LatestWind() (*FifteenSecWindMsg, error) {
+	f, err := scanFifteenSecWind(s.db.QueryRow("SELECT " + fifteenSecWindColumnList + " FROM housestation_15sec_wind ORDER BY ID DESC LIMIT 1"))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (s *sqlStore) LatestTenMin() (*TenMinAllRow, error) {
+	t, err := scanTenMinAllRow(s.db.QueryRow("SELECT " + tenMinAllColumnList + " FROM housestation_10min_all ORDER BY ID DESC LIMIT 1"))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *sqlStore) RecentWind(n int) ([]FifteenSecWindMsg, error) {
+	rows, err := s.db.Query("SELECT "+fifteenSecWindColumnList+" FROM (SELECT "+fifteenSecWindColumnList+" FROM housestation_15sec_wind ORDER BY ID DESC LIMIT ?) AS t ORDER BY ID", n)
+	if err != nil {
+		return nil, err
+	}
+	return collectFifteenSecWind(rows)
+}
+
+func (s *sqlStore) RecentTenMin(n int) ([]TenMinAllRow, error) {
+	rows, err := s.db.Query("SELECT "+tenMinAllColumnList+" FROM (SELECT "+tenMinAllColumnList+" FROM housestation_10min_all ORDER BY ID DESC LIMIT ?) AS t ORDER BY ID", n)
+	if err != nil {
+		return nil, err
+	}
+	return collectTenMinAllRows(rows)
+}
+
+func (s *sqlStore) WindRange(q RangeQuery) ([]FifteenSecWindMsg, error) {
+	where, args := s.rangeWhere(q)
+	rows, err := s.db.Query("SELECT "+fifteenSecWindColumnList+" FROM housestation_15sec_wind WHERE "+where+" ORDER BY ID LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	return collectFifteenSecWind(rows)
+}
+
+func (s *sqlStore) TenMinRange(q RangeQuery) ([]TenMinAllRow, error) {
+	where, args := s.rangeWhere(q)
+	rows, err := s.db.Query("SELECT "+tenMinAllColumnList+" FROM housestation_10min_all WHERE "+where+" ORDER BY ID LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	return collectTenMinAllRows(rows)
+}
+
+// rangeWhere builds the WHERE clause for q. The returned arguments end with q.Limit, for the LIMIT clause.
+func (s *sqlStore) rangeWhere(q RangeQuery) (string, []interface{}) {
+	conds := []string{"ID > ?"}
+	args := []interface{}{q.AfterID}
+	if !q.From.IsZero() {
+		conds = append(conds, "DateTime >= ?")
+		args = append(args, s.timeArg(q.From))
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, "DateTime < ?")
+		args = append(args, s.timeArg(q.To))
+	}
+	return strings.Join(conds, " AND "), append(args, q.Limit)
+}
+
+func (s *sqlStore) InsertWind(f *FifteenSecWindMsg) error {
+	res, err := s.db.Exec("INSERT INTO housestation_15sec_wind (DateTime, WindDirCur, WindDirCurEng, WindSpeedCur) VALUES (?, ?, ?, ?)",
+		s.timeArg(f.DateTime), f.WindDirCur, f.WindDirCurEng, f.WindSpeedCur)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	f.ID = int(id)
+	return err
+}
+
+func (s *sqlStore) InsertTenMin(t *TenMinAllRow) error {
+	res, err := s.db.Exec("INSERT INTO housestation_10min_all (DateTime, TempOutCur, HumOutCur, PressCur, DewCur, HeatIdxCur, WindChillCur, TempInCur, "+
+		"HumInCur, WindSpeedCur, WindAvgSpeedCur, WindDirCur, WindDirCurEng, WindGust10, WindDirAvg10, WindDirAvg10Eng, UVAvg10, UVMax10, "+
+		"SolarRadAvg10, SolarRadMax10, RainRateCur, RainDay, RainYest, RainMonth, RainYear) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		s.timeArg(t.DateTime), t.TempOutCur, t.HumOutCur, t.PressCur, t.DewCur, t.HeatIdxCur, t.WindChillCur, t.TempInCur,
+		t.HumInCur, t.WindSpeedCur, t.WindAvgSpeedCur, t.WindDirCur, t.WindDirCurEng, t.WindGust10, t.WindDirAvg10, t.WindDirAvg10Eng, t.UVAvg10, t.UVMax10,
+		t.SolarRadAvg10, t.SolarRadMax10, t.RainRateCur, t.RainDay, t.RainYest, t.RainMonth, t.RainYear)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	t.ID = int(id)
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanFifteenSecWind reads a single housestation_15sec_wind row, selected with fifteenSecWindColumnList.
+func scanFifteenSecWind(rs rowScanner) (FifteenSecWindMsg, error) {
+	f := FifteenSecWindMsg{}
+	err := rs.Scan(&f.ID, &f.DateTime, &f.WindDirCur, &f.WindDirCurEng, &f.WindSpeedCur)
+	return f, err
+}
+
+// scanTenMinAllRow reads a single housestation_10min_all row, selected with tenMinAllColumnList.
+func scanTenMinAllRow(rs rowScanner) (TenMinAllRow, error) {
+	t := TenMinAllRow{}
+	err := rs.Scan(&t.ID, &t.DateTime, &t.TempOutCur, &t.HumOutCur, &t.PressCur, &t.DewCur, &t.HeatIdxCur, &t.WindChillCur, &t.TempInCur,
+		&t.HumInCur, &t.WindSpeedCur, &t.WindAvgSpeedCur, &t.WindDirCur, &t.WindDirCurEng, &t.WindGust10, &t.WindDirAvg10, &t.WindDirAvg10Eng,
+		&t.UVAvg10, &t.UVMax10, &t.SolarRadAvg10, &t.SolarRadMax10, &t.RainRateCur, &t.RainDay, &t.RainYest, &t.RainMonth, &t.RainYear)
+	return t, err
+}
+
+// collectFifteenSecWind scans and closes rows.
+func collectFifteenSecWind(rows *sql.Rows) ([]FifteenSecWindMsg, error) {
+	defer rows.Close()
+	res := make([]FifteenSecWindMsg, 0)
+	for rows.Next() {
+		f, err := scanFifteenSecWind(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, f)
+	}
+	return res, rows.Err()
+}
+
+// collectTenMinAllRows scans and closes rows.
+func collectTenMinAllRows(rows *sql.Rows) ([]TenMinAllRow, error) {
+	defer rows.Close()
+	res := make([]TenMinAllRow, 0)
+	for rows.Next() {
+		t, err := scanTenMinAllRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
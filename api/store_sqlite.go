@@ -0,0 +1,26 @@
+package api
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLiteStore opens (creating if necessary) a SQLite database file at path, for running WeatherMoss
+// without a MySQL server.
+func NewSQLiteStore(path string) (Store, error) {
+	d, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer, so don't let database/sql open more connections than that.
+	d.SetMaxOpenConns(1)
+
+	// Nobody else is going to create the tables for us.
+	s := &sqlStore{db: d, dialect: dialectSQLite}
+	if _, err := s.Migrate(); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
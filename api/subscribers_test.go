@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestSubscribersUnderLoad connects and disconnects dozens of WebSocket and event stream clients while
+// readings are being ingested, then checks every subscription was removed and Shutdown doesn't hang.
+// Run it with -race.
+func TestSubscribersUnderLoad(t *testing.T) {
+	a := NewApiHandlers(NewMemoryStore(), time.UTC)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/ws", a.WsCombinedHandler)
+	mux.HandleFunc("/api/ws/15sec", a.WsFifteenSecHandler)
+	mux.HandleFunc("/api/sse", a.SseCombinedHandler)
+	mux.HandleFunc("/api/subscribers", a.Subscribers)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	stopIngest := make(chan struct{})
+	ingested := make(chan struct{})
+	go func() {
+		defer close(ingested)
+		for i := 0; ; i++ {
+			select {
+			case <-stopIngest:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			a.IngestWind(FifteenSecWindMsg{DateTime: time.Now(), WindDirCur: 180, WindDirCurEng: "S", WindSpeedCur: 5})
+			if i%20 == 0 {
+				a.IngestTenMin(TenMinAllRow{DateTime: time.Now(), TempOutCur: 60, HumOutCur: 50, PressCur: 30, DewCur: 45})
+			}
+		}
+	}()
+
+	policies := []OverflowPolicy{DropOldest, Coalesce, Disconnect}
+	var wg sync.WaitGroup
+	for i := 0; i < 60; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			policy := policies[i%len(policies)]
+			switch i % 4 {
+			case 0:
+				readEvents(t, srv.URL+"/api/sse?overflow="+string(policy), 5)
+			case 1:
+				resp, err := http.Get(srv.URL + "/api/subscribers")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			case 2:
+				readWS(t, wsURL+"/api/ws/15sec?overflow="+string(policy), 5, nil)
+			case 3:
+				readWS(t, wsURL+"/api/ws?overflow="+string(policy), 5, map[string]interface{}{"action": "unsubscribe", "types": []string{"Status"}})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// With nothing more to send, the subscriptions have to end as soon as the clients hang up, not
+	// when the next reading or ping is written.
+	close(stopIngest)
+	<-ingested
+	waitForSubscribers(t, a, 0)
+
+	idle := dialWS(t, a, wsURL+"/api/ws", 10)
+	for _, ws := range idle {
+		ws.Close()
+	}
+	waitForSubscribers(t, a, 0)
+
+	// Shutdown has to close the clients that are still connected.
+	open := dialWS(t, a, wsURL+"/api/ws", 10)
+	for _, ws := range open {
+		defer ws.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != nil {
+		t.Fatal("Shutdown:", err)
+	}
+	waitForSubscribers(t, a, 0)
+	for _, ws := range open {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+					t.Errorf("expected a going away close frame, got %v", err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// dialWS opens n WebSockets, and waits for them all to be subscribed.
+func dialWS(t *testing.T, a *ApiHandlers, url string, n int) []*websocket.Conn {
+	conns := make([]*websocket.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, ws)
+	}
+	waitForSubscribers(t, a, n)
+	return conns
+}
+
+// readWS reads n messages from a WebSocket, sending control first if it's given, and hangs up.
+func readWS(t *testing.T, url string, n int, control interface{}) {
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ws.Close()
+	if control != nil {
+		if err := ws.WriteJSON(control); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for i := 0; i < n; i++ {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+// readEvents reads n events from an event stream, and hangs up.
+func readEvents(t *testing.T, url string, n int) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("%s returned %s", url, resp.Status)
+		return
+	}
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "data: ") {
+			if n--; n == 0 {
+				return
+			}
+		}
+	}
+	t.Error("event stream ended early:", s.Err())
+}
+
+// waitForSubscribers waits up to 5 seconds for the monitor to have exactly n subscribers.
+func waitForSubscribers(t *testing.T, a *ApiHandlers, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.monitor.RLock()
+		got := len(a.monitor.subscribers)
+		a.monitor.RUnlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d subscribers, still have %d", n, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
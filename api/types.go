@@ -1,242 +1,374 @@
 package api
 
 import (
-	"database/sql"
-	_ "github.com/go-sql-driver/mysql"
+	"context"
 	jww "github.com/spf13/jwalterweatherman"
 	"sync"
 	"time"
 )
 
 const (
-	// How often does the monitor check the DB for an update?
+	// How often does the monitor check whether a table is due to be polled, unless configured otherwise?
+	// This is also the fastest any table is polled. See SetPollPeriod.
 	dbPollPeriod = 1 * time.Second
+
+	// Default number of messages that can wait for a slow subscriber. See SetSubscriberBuffer.
+	defaultSubscriberBuffer = 110
+
+	// The most rows read from a table in one poll. If there are more, the table is polled again at the next tick.
+	maxPollRows = 500
+
+	// How often the Meteobridge writes a row to each table.
+	fifteenSecCadence = 15 * time.Second
+	tenMinCadence     = 10 * time.Minute
 )
 
 type ApiHandlers struct {
-	db      *sql.DB
+	store   Store
+	loc     *time.Location // The station's local timezone
 	monitor *dbMonitor
+	alerts  *alertEngine
+
+	stop         context.CancelFunc // Stops the monitor and the live feeds, see Shutdown
+	stopping     <-chan struct{}    // Closed by stop
+	monitorDone  chan struct{}      // Closed when runMonitor returns
+	webhooks     chan AlertEvent    // Alerts waiting to be sent to the webhook, closed by runMonitor
+	webhooksDone chan struct{}      // Closed when sendWebhooks returns
+	streamsMu    sync.Mutex         // Guards adding to streams once stopping
+	streams      sync.WaitGroup     // Open WebSockets and event streams
+
+	// Settings that can be changed while running.
+	settingsMu          sync.RWMutex
+	ingestTokens        []string
+	corsOrigins         []string
+	overflowPolicy      OverflowPolicy
+	pollPeriod          time.Duration
+	backfillSize        int
+	subscriberBuffer    int
+	alertWebhook        string
+	alertWebhookTimeout time.Duration
 }
 
-func NewApiHandlers(d *sql.DB) *ApiHandlers {
+// NewApiHandlers creates the API handlers and starts monitoring s for new readings. loc is the timezone
+// the station records its DateTime values in; it's used to interpret request times and align aggregates.
+func NewApiHandlers(s Store, loc *time.Location) *ApiHandlers {
+	ctx, stop := context.WithCancel(context.Background())
 	a := &ApiHandlers{
-		db: d,
+		store:        s,
+		loc:          loc,
+		stop:         stop,
+		stopping:     ctx.Done(),
+		monitorDone:  make(chan struct{}),
+		webhooks:     make(chan AlertEvent, webhookQueueSize),
+		webhooksDone: make(chan struct{}),
+		alerts:       &alertEngine{},
+
+		pollPeriod:       dbPollPeriod,
+		backfillSize:     defaultBackfillSize,
+		subscriberBuffer: defaultSubscriberBuffer,
 		monitor: &dbMonitor{
 			lastFifteenSecResTime: time.Unix(0, 0),
 			lastTenMinResTime:     time.Unix(0, 0),
+			status:                SourceStatus{Source: "database", Online: true, Since: time.Now()},
+			fifteenSecPoll:        newTablePoll(fifteenSecCadence),
+			tenMinPoll:            newTablePoll(tenMinCadence),
+			qc:                    newQCState(),
+			incoming:              make(chan WSMessage, 10),
 			subscribers:           make(([]*subscriber), 0),
 		},
 	}
-	go a.runMonitor()
+	go a.runMonitor(ctx)
+	go a.sendWebhooks()
 
 	return a
 }
 
 type subscriber struct {
-	bufChan  chan WSMessage
-	quitChan chan bool
+	dropped    uint64 // Messages lost to the overflow policy. First, so it's aligned for sync/atomic
+	id         int
+	name       string // Which feed the subscriber is reading
+	remote     string
+	connected  time.Time
+	policy     OverflowPolicy
+	overflowed bool           // Set by the monitor when it closes slow
+	slow       chan struct{}  // Closed if the subscriber must be disconnected for falling behind
+	bufChan    chan WSMessage // Only ever sent to by the monitor, and never closed
 
 	sync.RWMutex
 }
 
-func getSubscriber() *subscriber {
+func getSubscriber(name, remote string, policy OverflowPolicy, size int) *subscriber {
 	return &subscriber{
-		bufChan:  make(chan WSMessage, 110),
-		quitChan: make(chan bool),
-	} // TODO: Tune arbitrary size 110 as necessary. Designed to allow full backfill of 100 results to a combined subscriber
+		name:      name,
+		remote:    remote,
+		connected: time.Now(),
+		policy:    policy,
+		slow:      make(chan struct{}),
+		bufChan:   make(chan WSMessage, size),
+	}
 }
 
 type dbMonitor struct {
 	lastFifteenSecResTime time.Time
 	lastTenMinResTime     time.Time
+	lastFifteenSecID      int // ID of the newest row seen in each table; only new rows are polled for
+	lastTenMinID          int
 	latestFifteenSecRes   WSMessage
 	latestTenMinRes       WSMessage
+	started               bool // Whether the monitor has found where each table ends
+	status                SourceStatus
+	forecast              *LocalForecast // nil until there's enough pressure history
+	qc                    *qcState       // Flags new readings; only used by runMonitor
+	retryBackoff          time.Duration  // Delay before the next attempt while the database is unavailable
+	retryAt               time.Time
+	fifteenSecPoll        *tablePoll
+	tenMinPoll            *tablePoll
+	incoming              chan WSMessage // Readings ingested directly, see IngestTenMin
 	subscribers           []*subscriber
+	lastSubscriberID      int
 	sync.RWMutex
 }
 
-// getDBObserver gets a new channel that can be used to listen for database updates
-func (a *ApiHandlers) getDBSubscriber() *subscriber {
-	ns := getSubscriber()
-	a.monitor.Lock()
-	a.monitor.subscribers = append(a.monitor.subscribers, ns)
-	cl := len(a.monitor.subscribers)
-	a.monitor.Unlock()
-	jww.INFO.Println("Subscriber Created. There are now", cl, "subscribers.")
-	//defer a.notifyOfLatest(ns)
-	defer a.backfill(ns)
-	return ns
+// tablePoll decides when a table next needs polling. Rows arrive on a known cadence, so once one
+// has been seen there's no point asking for the next until it's nearly due. After that the table is
+// polled with an increasing interval, which caps out at a quarter of the cadence in case the
+// Meteobridge has stopped writing altogether.
+type tablePoll struct {
+	cadence  time.Duration
+	interval time.Duration
+	next     time.Time
 }
 
-// notifyOfLatest adds the most recent values the monitor has collected to a (usually newly-created)
-// observer's channel, without blocking and preventing the observer from picking them up.
-func (a *ApiHandlers) notifyOfLatest(s *subscriber) {
-	go func(ia *ApiHandlers, is *subscriber) {
-		is.bufChan <- ia.monitor.latestFifteenSecRes
-		is.bufChan <- ia.monitor.latestTenMinRes
-	}(a, s)
+func newTablePoll(cadence time.Duration) *tablePoll {
+	return &tablePoll{cadence: cadence, interval: dbPollPeriod}
 }
 
-// backfill gets the last 40 results of each table and pushes them, in-order, onto the websocket queue.
-// This allows the new subscriber to recieve enough data to fill in charts and graphs immediately.
-func (a *ApiHandlers) backfill(s *subscriber) {
-	go func(ia *ApiHandlers, is *subscriber) {
-		rows, err := a.db.Query("SELECT * FROM ( SELECT * FROM housestation_15sec_wind ORDER BY ID DESC LIMIT 50 ) AS t ORDER BY ID")
-		if err != nil {
-			jww.ERROR.Println(err)
-		}
-		defer rows.Close()
-		for rows.Next() {
-			f := FifteenSecWindMsg{}
-			err := rows.Scan(&f.ID, &f.DateTime, &f.WindDirCur, &f.WindDirCurEng, &f.WindSpeedCur)
-			if err != nil {
-				jww.ERROR.Println(err)
-			}
-
-			r1 := WSMessage{
-				MsgType: FifteenSecWind,
-				Payload: f,
-			}
-
-			is.bufChan <- r1
+// due reports whether the table should be polled at now.
+func (p *tablePoll) due(now time.Time) bool {
+	return !now.Before(p.next)
+}
 
+// polled schedules the next poll, given how many rows the one at now returned. period is the monitor's
+// poll period, the shortest interval between polls.
+func (p *tablePoll) polled(now time.Time, rows int, period time.Duration) {
+	switch {
+	case rows >= maxPollRows:
+		// There's a backlog, so keep reading.
+		p.next = now
+	case rows > 0:
+		p.interval = period
+		p.next = now.Add(p.cadence - p.cadence/10)
+	default:
+		p.next = now.Add(p.interval)
+		p.interval *= 2
+		if p.interval > p.cadence/4 {
+			p.interval = p.cadence / 4
 		}
-		err = rows.Err()
-		if err != nil {
-			jww.ERROR.Println(err)
-		}
+	}
+}
 
-		// See if there's an updated 10 minute result
-		trrows, err := a.db.Query("SELECT * FROM (SELECT * FROM housestation_10min_all ORDER BY ID DESC LIMIT 50) AS t ORDER BY ID")
-		if err != nil {
-			jww.ERROR.Println(err)
-		}
-		defer trrows.Close()
-		for trrows.Next() {
-			t := TenMinAllRow{}
-			err := trrows.Scan(&t.ID, &t.DateTime, &t.TempOutCur, &t.HumOutCur, &t.PressCur, &t.DewCur, &t.HeatIdxCur, &t.WindChillCur, &t.TempInCur,
-				&t.HumInCur, &t.WindSpeedCur, &t.WindAvgSpeedCur, &t.WindDirCur, &t.WindDirCurEng, &t.WindGust10, &t.WindDirAvg10, &t.WindDirAvg10Eng,
-				&t.UVAvg10, &t.UVMax10, &t.SolarRadAvg10, &t.SolarRadMax10, &t.RainRateCur, &t.RainDay, &t.RainYest, &t.RainMonth, &t.RainYear)
-			if err != nil {
-				jww.ERROR.Println(err)
-			}
+// getDBSubscriber subscribes to the readings the monitor finds, until ctx is cancelled. The subscriber
+// is registered before it's returned, so nothing published after the call is missed, and is removed as
+// soon as ctx is done; it's then safe to stop reading from bufChan.
+func (a *ApiHandlers) getDBSubscriber(ctx context.Context, name, remote string, policy OverflowPolicy) *subscriber {
+	ns := getSubscriber(name, remote, policy, a.getSubscriberBuffer())
+	a.monitor.Lock()
+	a.monitor.lastSubscriberID++
+	ns.id = a.monitor.lastSubscriberID
+	a.monitor.subscribers = append(a.monitor.subscribers, ns)
+	cl := len(a.monitor.subscribers)
+	a.monitor.Unlock()
+	jww.INFO.Println("Subscriber Created. There are now", cl, "subscribers.")
 
-			r2 := WSMessage{MsgType: TenMinute, Payload: t}
-			is.bufChan <- r2
+	go func() {
+		<-ctx.Done()
+		a.removeSubscriber(ns)
+	}()
+	return ns
+}
+
+// removeSubscriber stops the monitor sending to s. Once it returns, nothing more is sent to s.bufChan.
+func (a *ApiHandlers) removeSubscriber(s *subscriber) {
+	a.monitor.Lock()
+	subs := make([]*subscriber, 0, len(a.monitor.subscribers))
+	for _, other := range a.monitor.subscribers {
+		if other != s {
+			subs = append(subs, other)
 		}
-	}(a, s)
+	}
+	a.monitor.subscribers = subs
+	a.monitor.Unlock()
+	jww.INFO.Println("Subscriber Closed. There are now", len(subs), "subscribers.")
 }
 
-// runMonitor starts the monitor for this ApiHandlers objects
-func (a *ApiHandlers) runMonitor() {
-	dbTicker := time.NewTicker(dbPollPeriod)
-	cleanupTicker := time.NewTicker(5 * time.Second)
+// runMonitor starts the monitor for this ApiHandlers objects. It runs until ctx is cancelled.
+func (a *ApiHandlers) runMonitor(ctx context.Context) {
+	period := a.getPollPeriod()
+	dbTicker := time.NewTicker(period)
 	defer func() {
 		dbTicker.Stop()
-		cleanupTicker.Stop()
+		close(a.webhooks)
+		close(a.monitorDone)
 	}()
 
 	for {
 		select {
-		case <-cleanupTicker.C:
-			a.monitor.RLock()
-			for i := len(a.monitor.subscribers) - 1; i >= 0; i-- {
-				s := a.monitor.subscribers[i]
-				select {
-				case <-s.quitChan:
-					// This subscriber has been set to quit, so we'll remove it from our loop
-					a.monitor.subscribers = append(a.monitor.subscribers[:i], a.monitor.subscribers[i+1:]...)
-					sc := len(a.monitor.subscribers)
-					close(s.bufChan) // TODO: Is this possible to panic? Any chance we async read after the close?
-					jww.INFO.Println("Subscriber Closed. There are now", sc, "subscribers.")
-				default:
-					// Nothing, we just carry on
-				}
+		case <-ctx.Done():
+			return
+		case now := <-dbTicker.C:
+			if p := a.getPollPeriod(); p != period {
+				period = p
+				dbTicker.Stop()
+				dbTicker = time.NewTicker(period)
+			}
+			if now.Before(a.monitor.retryAt) {
+				// Backing off after a failure
+				continue
 			}
-			a.monitor.RUnlock()
-		case <-dbTicker.C:
-			results, err := pollDB(a)
 
+			results, err := pollDB(a)
+			a.notifySubscribers(results)
+			a.updateForecast(results)
+			a.checkAlerts(results)
 			if err != nil {
-				// Errors have been logged upstream in polldb.
-				// TODO: Can we return an error state to the client? Do they need to retry?
-				return
+				a.sourceFailed(err)
+			} else {
+				a.sourceRecovered()
 			}
-
-			// Notify all observers of update
-			for i := len(a.monitor.subscribers) - 1; i >= 0; i-- {
-				s := a.monitor.subscribers[i]
-
-				for _, r := range results {
-					select {
-					case s.bufChan <- r:
-						// Nothing to do, we've written out to the subscriber
-					default:
-						// This should only occur if we coludn't write to the buffered channel, which only happens if it's full
-						// TODO: could this also occur when the pollDB doesn't have a result?
-						jww.ERROR.Println("subscriber buffer overflowed!")
-					}
-				}
+		case msg := <-a.monitor.incoming:
+			// A reading pushed to us directly, rather than found in the database.
+			if msg, ok := a.monitor.record(msg); ok {
+				a.notifySubscribers([]WSMessage{msg})
+				a.updateForecast([]WSMessage{msg})
+				a.checkAlerts([]WSMessage{msg})
 			}
 		}
 	}
 }
 
-// pollDB is a helper function to runMonitor() and is being called every dbTicker seconds
-// pollDB only outputs results in the case that the latest information from the database
-// is newer than the most recent data cached in the monitor.
+// notifySubscribers hands each result to every subscriber. It must only be called from runMonitor.
+// Holding the read lock keeps subscribers from being removed part way through.
+func (a *ApiHandlers) notifySubscribers(results []WSMessage) {
+	a.monitor.RLock()
+	defer a.monitor.RUnlock()
+
+	// Notify all observers of update
+	for i := len(a.monitor.subscribers) - 1; i >= 0; i-- {
+		s := a.monitor.subscribers[i]
+
+		for _, r := range results {
+			s.offer(r)
+		}
+	}
+}
+
+// record caches msg as the latest reading of its type, if it's newer than the one the monitor already
+// has, and returns it with its QC flags. It reports whether msg was new; a reading seen both from the
+// database and from ingestion is only published once. Readings that were ingested but couldn't be stored
+// have no ID, and are compared by time.
+func (m *dbMonitor) record(msg WSMessage) (WSMessage, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	switch p := msg.Payload.(type) {
+	case FifteenSecWindMsg:
+		if p.ID > 0 && p.ID <= m.lastFifteenSecID || p.ID == 0 && !p.DateTime.After(m.lastFifteenSecResTime) {
+			return msg, false
+		}
+		if p.ID > 0 {
+			m.lastFifteenSecID = p.ID
+		}
+		m.lastFifteenSecResTime = p.DateTime
+		msg.Payload = m.qc.flagWind(p)
+		m.latestFifteenSecRes = msg
+	case TenMinAllRow:
+		if p.ID > 0 && p.ID <= m.lastTenMinID || p.ID == 0 && !p.DateTime.After(m.lastTenMinResTime) {
+			return msg, false
+		}
+		if p.ID > 0 {
+			m.lastTenMinID = p.ID
+		}
+		m.lastTenMinResTime = p.DateTime
+		msg.Payload = m.qc.flagTenMin(p)
+		m.latestTenMinRes = msg
+	}
+	return msg, true
+}
+
+// pollDB is a helper function to runMonitor() and is being called every dbTicker seconds.
+// It reads every row added to each table since the newest one the monitor has seen, for the
+// tables that are due to be polled, and returns them oldest first. Rows read before an error are
+// still returned along with it.
 func pollDB(a *ApiHandlers) ([]WSMessage, error) {
 	res := make([]WSMessage, 0)
+	now := time.Now()
 
-	rows, err := a.db.Query("SELECT * FROM housestation_15sec_wind ORDER BY ID DESC LIMIT 1")
-	if err != nil {
-		jww.ERROR.Println(err)
-	}
-	defer rows.Close()
-	for rows.Next() {
-		f := FifteenSecWindMsg{}
-		err := rows.Scan(&f.ID, &f.DateTime, &f.WindDirCur, &f.WindDirCurEng, &f.WindSpeedCur)
+	if !a.monitor.started {
+		// Start from the current end of each table, rather than replaying the whole history.
+		f, err := a.store.LatestWind()
 		if err != nil {
-			jww.ERROR.Println(err)
+			return nil, err
+		}
+		t, err := a.store.LatestTenMin()
+		if err != nil {
+			return nil, err
+		}
+		// Give the QC checks the recent history to compare new readings with.
+		if f != nil {
+			a.primeWind(a.monitor.qc, f.DateTime)
+			if msg, ok := a.monitor.record(WSMessage{MsgType: FifteenSecWind, Payload: *f}); ok {
+				res = append(res, msg)
+			}
+		}
+		if t != nil {
+			a.primeTenMin(a.monitor.qc, t.DateTime)
+			if msg, ok := a.monitor.record(WSMessage{MsgType: TenMinute, Payload: *t}); ok {
+				res = append(res, msg)
+			}
 		}
+		a.monitor.started = true
+		return res, nil
+	}
 
-		if f.DateTime.After(a.monitor.lastFifteenSecResTime) {
+	if a.monitor.fifteenSecPoll.due(now) {
+		a.monitor.RLock()
+		after := a.monitor.lastFifteenSecID
+		a.monitor.RUnlock()
+
+		rows, err := a.store.WindRange(RangeQuery{AfterID: after, Limit: maxPollRows})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range rows {
 			r1 := WSMessage{
 				MsgType: FifteenSecWind,
 				Payload: f,
 			}
-			res = append(res, r1)
-			a.monitor.lastFifteenSecResTime = f.DateTime
-			a.monitor.latestFifteenSecRes = r1
+			if r1, ok := a.monitor.record(r1); ok {
+				res = append(res, r1)
+			}
 		}
-
-	}
-	err = rows.Err()
-	if err != nil {
-		jww.ERROR.Println(err)
+		a.monitor.fifteenSecPoll.polled(now, len(rows), a.getPollPeriod())
 	}
 
-	// See if there's an updated 10 minute result
-	trrows, err := a.db.Query("SELECT * FROM housestation_10min_all ORDER BY ID DESC LIMIT 1")
-	if err != nil {
-		jww.ERROR.Println(err)
-	}
-	defer trrows.Close()
-	for trrows.Next() {
-		t := TenMinAllRow{}
-		err := trrows.Scan(&t.ID, &t.DateTime, &t.TempOutCur, &t.HumOutCur, &t.PressCur, &t.DewCur, &t.HeatIdxCur, &t.WindChillCur, &t.TempInCur,
-			&t.HumInCur, &t.WindSpeedCur, &t.WindAvgSpeedCur, &t.WindDirCur, &t.WindDirCurEng, &t.WindGust10, &t.WindDirAvg10, &t.WindDirAvg10Eng,
-			&t.UVAvg10, &t.UVMax10, &t.SolarRadAvg10, &t.SolarRadMax10, &t.RainRateCur, &t.RainDay, &t.RainYest, &t.RainMonth, &t.RainYear)
+	// See if there are new 10 minute results
+	if a.monitor.tenMinPoll.due(now) {
+		a.monitor.RLock()
+		after := a.monitor.lastTenMinID
+		a.monitor.RUnlock()
+
+		rows, err := a.store.TenMinRange(RangeQuery{AfterID: after, Limit: maxPollRows})
 		if err != nil {
-			jww.ERROR.Println(err)
+			// The wind rows already read have been recorded, so they must still be delivered.
+			return res, err
 		}
-
-		if t.DateTime.After(a.monitor.lastTenMinResTime) {
+		for _, t := range rows {
 			r2 := WSMessage{MsgType: TenMinute, Payload: t}
-			res = append(res, r2)
-			a.monitor.lastTenMinResTime = t.DateTime
-			a.monitor.latestTenMinRes = r2
+			if r2, ok := a.monitor.record(r2); ok {
+				res = append(res, r2)
+			}
 		}
+		a.monitor.tenMinPoll.polled(now, len(rows), a.getPollPeriod())
 	}
 
 	if len(res) > 0 {
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// UnitSystem is a set of units readings can be served in. The Meteobridge template stores them in
+// Imperial units (=F, =mph, =inHg.2, =in.2), and anything else is converted on the way out.
+type UnitSystem string
+
+const (
+	Imperial UnitSystem = "imperial"
+	Metric   UnitSystem = "metric"
+	SI       UnitSystem = "si"
+)
+
+// Units names the unit of each kind of measurement in a payload.
+type Units struct {
+	System      UnitSystem `json:"system"`
+	Temperature string     `json:"temperature"`
+	Pressure    string     `json:"pressure"`
+	WindSpeed   string     `json:"windSpeed"`
+	Rain        string     `json:"rain"`
+	RainRate    string     `json:"rainRate"`
+	Height      string     `json:"height"`
+}
+
+// Rain is given in millimetres (kg/m²) in SI too, as is conventional.
+var unitSets = map[UnitSystem]Units{
+	Imperial: {System: Imperial, Temperature: "F", Pressure: "inHg", WindSpeed: "mph", Rain: "in", RainRate: "in/h", Height: "ft"},
+	Metric:   {System: Metric, Temperature: "C", Pressure: "hPa", WindSpeed: "km/h", Rain: "mm", RainRate: "mm/h", Height: "m"},
+	SI:       {System: SI, Temperature: "K", Pressure: "Pa", WindSpeed: "m/s", Rain: "mm", RainRate: "mm/h", Height: "m"},
+}
+
+// parseUnitsParam reads the units query parameter, which defaults to Imperial.
+func parseUnitsParam(r *http.Request) (UnitSystem, error) {
+	s := r.URL.Query().Get("units")
+	if s == "" {
+		return Imperial, nil
+	}
+	if _, ok := unitSets[UnitSystem(s)]; !ok {
+		return "", fmt.Errorf("invalid units parameter %q, expected metric, imperial or si", s)
+	}
+	return UnitSystem(s), nil
+}
+
+// Units returns the names of the units in u.
+func (u UnitSystem) Units() Units {
+	return unitSets[u]
+}
+
+// temp converts a temperature from Fahrenheit.
+func (u UnitSystem) temp(f float64) float64 {
+	switch u {
+	case Metric:
+		return round((f-32)*5/9, 1)
+	case SI:
+		return round((f-32)*5/9+273.15, 2)
+	}
+	return f
+}
+
+// tempC converts a calculated temperature from Celsius.
+func (u UnitSystem) tempC(c float64) float64 {
+	switch u {
+	case Imperial:
+		return round(c*9/5+32, 1)
+	case SI:
+		return round(c+273.15, 2)
+	}
+	return round(c, 1)
+}
+
+// height converts a height from metres.
+func (u UnitSystem) height(m float64) float64 {
+	if u == Imperial {
+		return round(m/0.3048, 0)
+	}
+	return round(m, 0)
+}
+
+// pressure converts a pressure from inches of mercury.
+func (u UnitSystem) pressure(inHg float64) float64 {
+	switch u {
+	case Metric:
+		return round(inHg*33.8638866667, 1)
+	case SI:
+		return round(inHg*3386.38866667, 0)
+	}
+	return inHg
+}
+
+// wind converts a speed from miles per hour.
+func (u UnitSystem) wind(mph float64) float64 {
+	switch u {
+	case Metric:
+		return round(mph*1.609344, 1)
+	case SI:
+		return round(mph*0.44704, 2)
+	}
+	return mph
+}
+
+// rain converts a depth (or rate) of rain from inches.
+func (u UnitSystem) rain(in float64) float64 {
+	if u == Imperial {
+		return in
+	}
+	return round(in*25.4, 2)
+}
+
+// round rounds v to n decimal places, so conversions don't add spurious precision.
+func round(v float64, n int) float64 {
+	p := math.Pow(10, float64(n))
+	return math.Floor(v*p+0.5) / p
+}
+
+// tenMin converts a 10 minute row's temperatures, pressure, wind speeds and rain to u.
+func (u UnitSystem) tenMin(t TenMinAllRow) TenMinAllRow {
+	if u == Imperial {
+		return t
+	}
+	t.TempOutCur = u.temp(t.TempOutCur)
+	t.DewCur = u.temp(t.DewCur)
+	t.HeatIdxCur = u.temp(t.HeatIdxCur)
+	t.WindChillCur = u.temp(t.WindChillCur)
+	t.TempInCur = u.temp(t.TempInCur)
+	t.PressCur = u.pressure(t.PressCur)
+	t.WindSpeedCur = u.wind(t.WindSpeedCur)
+	t.WindAvgSpeedCur = u.wind(t.WindAvgSpeedCur)
+	t.WindGust10 = u.wind(t.WindGust10)
+	t.RainRateCur = u.rain(t.RainRateCur)
+	t.RainDay = u.rain(t.RainDay)
+	t.RainYest = u.rain(t.RainYest)
+	t.RainMonth = u.rain(t.RainMonth)
+	t.RainYear = u.rain(t.RainYear)
+	return t
+}
+
+// fifteenSecWind converts a wind reading's speed to u.
+func (u UnitSystem) fifteenSecWind(f FifteenSecWindMsg) FifteenSecWindMsg {
+	f.WindSpeedCur = u.wind(f.WindSpeedCur)
+	return f
+}
+
+// TenMinOut is how a 10 minute row is sent to clients, converted to the units they asked for and with
+// its Derived values and QC flags. Stream messages are tagged with the units; REST documents tag the
+// whole document instead.
+type TenMinOut struct {
+	TenMinAllRow
+	Derived *Derived `json:"derived"`
+	QC      QCFlags  `json:"qc,omitempty"`
+	Units   *Units   `json:"units,omitempty"`
+}
+
+// tenMinOut converts t to u, and adds its Derived values.
+func tenMinOut(t TenMinAllRow, u UnitSystem) TenMinOut {
+	d := derive(t, u)
+	return TenMinOut{TenMinAllRow: u.tenMin(t), Derived: &d, QC: t.qc}
+}
+
+// render returns the row as it's sent: trimmed to fields, like selectFields, if any are given, and with
+// the readings that failed QC, and the derived values calculated from them, replaced by null if
+// nullSuspect is set. The derived values, QC flags and units are always kept.
+func (o TenMinOut) render(fields []string, nullSuspect bool) interface{} {
+	nulling := nullSuspect && o.QC.suspect()
+	if len(fields) == 0 && !nulling {
+		return o
+	}
+
+	m := rowMap(o.TenMinAllRow)
+	if len(fields) > 0 {
+		m = selectFields(o.TenMinAllRow, fields).(map[string]interface{})
+	}
+	m["derived"] = o.Derived
+	if o.QC != nil {
+		m["qc"] = o.QC
+	}
+	if o.Units != nil {
+		m["units"] = o.Units
+	}
+	if nulling {
+		o.QC.null(m)
+		m["derived"] = o.Derived.null(o.QC)
+	}
+	return m
+}
+
+// FifteenSecWindOut is the wind reading equivalent of TenMinOut.
+type FifteenSecWindOut struct {
+	FifteenSecWindMsg
+	QC    QCFlags `json:"qc,omitempty"`
+	Units *Units  `json:"units,omitempty"`
+}
+
+// windOut converts f to u.
+func windOut(f FifteenSecWindMsg, u UnitSystem) FifteenSecWindOut {
+	return FifteenSecWindOut{FifteenSecWindMsg: u.fifteenSecWind(f), QC: f.qc}
+}
+
+// render returns the reading as it's sent, with the readings that failed QC replaced by null if
+// nullSuspect is set.
+func (o FifteenSecWindOut) render(nullSuspect bool) interface{} {
+	if !nullSuspect || !o.QC.suspect() {
+		return o
+	}
+	m := rowMap(o.FifteenSecWindMsg)
+	m["qc"] = o.QC
+	if o.Units != nil {
+		m["units"] = o.Units
+	}
+	o.QC.null(m)
+	return m
+}
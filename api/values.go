@@ -0,0 +1,72 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The layout of DateTime values written by the Meteobridge ("[YYYY]-[MM]-[DD] [hh]:[mm]:[ss]").
+const meteobridgeTimeLayout = "2006-01-02 15:04:05"
+
+// ParseTenMinAllRow builds a TenMinAllRow from a set of values keyed by column name, as produced by a
+// Meteobridge template or HTTP request event. Every column except ID is required. DateTime is read in loc.
+func ParseTenMinAllRow(v url.Values, loc *time.Location) (TenMinAllRow, error) {
+	t := TenMinAllRow{}
+	err := parseValues(v, loc, &t)
+	return t, err
+}
+
+// ParseFifteenSecWind is the housestation_15sec_wind equivalent of ParseTenMinAllRow.
+func ParseFifteenSecWind(v url.Values, loc *time.Location) (FifteenSecWindMsg, error) {
+	f := FifteenSecWindMsg{}
+	err := parseValues(v, loc, &f)
+	return f, err
+}
+
+// parseValues fills each field of the struct dst points to from the value of the same name.
+func parseValues(v url.Values, loc *time.Location, dst interface{}) error {
+	rv := reflect.ValueOf(dst).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name := rt.Field(i).Name
+		if name == "ID" || rt.Field(i).PkgPath != "" {
+			continue
+		}
+
+		s := strings.TrimSpace(v.Get(name))
+		if s == "" {
+			return fmt.Errorf("missing value for %s", name)
+		}
+
+		field := rv.Field(i)
+		switch field.Interface().(type) {
+		case time.Time:
+			t, err := time.ParseInLocation(meteobridgeTimeLayout, s, loc)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q, expected YYYY-MM-DD hh:mm:ss", name, s)
+			}
+			field.Set(reflect.ValueOf(t))
+		case int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q, expected an integer", name, s)
+			}
+			field.SetInt(int64(n))
+		case float64:
+			// ParseFloat accepts NaN and Inf, which can't be encoded as JSON.
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return fmt.Errorf("invalid %s %q, expected a number", name, s)
+			}
+			field.SetFloat(f)
+		case string:
+			field.SetString(s)
+		}
+	}
+	return nil
+}
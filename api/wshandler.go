@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"github.com/gorilla/websocket"
 	jww "github.com/spf13/jwalterweatherman"
 	"net/http"
@@ -17,8 +18,8 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer. Big enough for a control message listing every field.
+	maxMessageSize = 4096
 )
 
 var (
@@ -28,109 +29,141 @@ var (
 	}
 )
 
+// WsCombinedHandler serves every message type on one connection. Clients can change what they
+// receive with control messages; see wsClient.
 func (a *ApiHandlers) WsCombinedHandler(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		if _, ok := err.(websocket.HandshakeError); !ok {
-			jww.FATAL.Println(err)
-		}
-		return
-	}
-
-	go writer(ws, a)
-	reader(ws)
+	a.serveWS(w, r, "combined", false, FifteenSecWind, TenMinute, Status, Forecast, Alert)
 }
 
+// WsFifteenSecHandler serves only FifteenSecWind messages.
 func (a *ApiHandlers) WsFifteenSecHandler(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	a.serveWS(w, r, "15Sec", true, FifteenSecWind)
+}
+
+// WsTenMinuteHandler serves only TenMinute messages.
+func (a *ApiHandlers) WsTenMinuteHandler(w http.ResponseWriter, r *http.Request) {
+	a.serveWS(w, r, "10Minute", true, TenMinute)
+}
+
+// serveWS upgrades the request to a WebSocket, and streams it messages of the given types.
+func (a *ApiHandlers) serveWS(w http.ResponseWriter, r *http.Request, name string, fixed bool, types ...MsgType) {
+	since, err := parseStreamCursor(r.URL.Query().Get("since"))
 	if err != nil {
-		if _, ok := err.(websocket.HandshakeError); !ok {
-			jww.FATAL.Println(err)
-		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	policy, err := a.overflowPolicyParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	units, err := parseUnitsParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	null, err := parseSuspectParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	go writerFifteenSec(ws, a)
-	reader(ws)
-}
+	if !a.beginStream() {
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
 
-func (a *ApiHandlers) WsTenMinuteHandler(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	u := upgrader
+	u.CheckOrigin = a.checkOrigin
+	ws, err := u.Upgrade(w, r, nil)
 	if err != nil {
 		if _, ok := err.(websocket.HandshakeError); !ok {
 			jww.FATAL.Println(err)
 		}
+		a.endStream()
 		return
 	}
 
-	go writerTenMin(ws, a)
-	reader(ws)
+	// The connection outlives the request, so the subscription is ended by the writer instead.
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newWSClient(name, a.getDBSubscriber(ctx, name, r.RemoteAddr, policy), fixed, types...)
+	c.units, c.null = units, null
+	go writer(ws, a, c, since, cancel)
+	reader(ws, c)
 }
 
-// required PONG implementation
-func reader(ws *websocket.Conn) {
+// required PONG implementation. Client messages are passed on to the writer as control messages,
+// unless the client's subscription is fixed, in which case they're ignored. When the connection
+// fails, the writer is told to stop straight away, rather than on its next write.
+func reader(ws *websocket.Conn, c *wsClient) {
 	defer ws.Close()
-	ws.SetReadLimit(512)
+	defer close(c.hungUp)
+	ws.SetReadLimit(maxMessageSize)
 	ws.SetReadDeadline(time.Now().Add(pongWait))
 	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		_, _, err := ws.ReadMessage()
+		_, data, err := ws.ReadMessage()
 		if err != nil {
 			break
 		}
+		if c.fixed {
+			continue
+		}
+
+		select {
+		case c.control <- data:
+		case <-c.done:
+			return
+		}
 	}
 }
 
-// writer runs in a goroutine for each connected WS client. It emits all message returned by the observer.
-func writer(ws *websocket.Conn, a *ApiHandlers) {
+// writer runs in a goroutine for each connected WS client. It catches the client up from storage,
+// then emits the messages returned by the observer that the client is subscribed to, and carries out
+// the client's control messages. It's the only goroutine that writes to ws.
+func writer(ws *websocket.Conn, a *ApiHandlers, c *wsClient, since *streamCursor, unsubscribe context.CancelFunc) {
 	pingTicker := time.NewTicker(pingPeriod)
-	s := a.getDBSubscriber()
-	jww.INFO.Println("Opened WebSocket connection.")
-	defer func(is *subscriber) {
-		jww.INFO.Println("Closing WebSocket connection.")
-		is.quitChan <- true
+	jww.INFO.Println("Opened", c.name, "WebSocket connection.")
+	defer func() {
+		jww.INFO.Println("Closing", c.name, "WebSocket connection.")
+		unsubscribe()
+		close(c.done)
 		pingTicker.Stop()
 		ws.Close()
-	}(s)
+		a.endStream()
+	}()
+
+	out := wsSink{ws}
+	if err := a.catchUp(out, c, since); err != nil {
+		return
+	}
 
 	for {
 		select {
-		case msg := <-s.bufChan:
-			ws.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := ws.WriteJSON(msg); err != nil {
+		case msg := <-c.sub.bufChan:
+			if err := a.fillGap(out, c); err != nil {
 				return
 			}
-		case <-pingTicker.C:
-			ws.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if c.sent.covers(msg) {
+				// Already sent while catching up
+				continue
+			}
+			if err := c.send(out, msg); err != nil {
 				return
 			}
-		}
-	}
-}
-
-// writerTenMin runs in a goroutine for each connected WS client, but only
-// emits a message on the connected socket if the monitor returns a new
-// TenMinute message.
-func writerTenMin(ws *websocket.Conn, a *ApiHandlers) {
-	pingTicker := time.NewTicker(pingPeriod)
-	s := a.getDBSubscriber()
-	jww.INFO.Println("Opened 10Minute WebSocket connection.")
-	defer func(is *subscriber) {
-		jww.INFO.Println("Closing 10Minute Websocket Connection.")
-		is.quitChan <- true
-		pingTicker.Stop()
-		ws.Close()
-	}(s)
-
-	for {
-		select {
-		case msg := <-s.bufChan:
-			if msg.MsgType == TenMinute {
-				ws.SetWriteDeadline(time.Now().Add(writeWait))
-				if err := ws.WriteJSON(msg); err != nil {
-					return
-				}
+		case <-c.hungUp:
+			return
+		case <-a.stopping:
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(writeWait))
+			return
+		case <-c.sub.slow:
+			// Disconnected by the overflow policy. The client can resume from the last message it was sent.
+			reason := "too slow, reconnect with since=" + c.sent.String()
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(writeWait))
+			return
+		case data := <-c.control:
+			if err := a.handleControl(out, c, data); err != nil {
+				return
 			}
 		case <-pingTicker.C:
 			ws.SetWriteDeadline(time.Now().Add(writeWait))
@@ -141,34 +174,17 @@ func writerTenMin(ws *websocket.Conn, a *ApiHandlers) {
 	}
 }
 
-// writerFifteenSec runs in a goroutine for each connected WS client, but only
-// emits a message on the connected socket if the monitor returns a new
-// FifteenSecWind message.
-func writerFifteenSec(ws *websocket.Conn, a *ApiHandlers) {
-	pingTicker := time.NewTicker(pingPeriod)
-	s := a.getDBSubscriber()
-	jww.INFO.Println("Opened 15Sec WebSocket connection.")
-	defer func(is *subscriber) {
-		jww.INFO.Println("Closing 15Sec Websocket Connection.")
-		is.quitChan <- true
-		pingTicker.Stop()
-		ws.Close()
-	}(s)
+// messageSink is a connection WSMessages are streamed down: a WebSocket, or a server-sent event stream.
+type messageSink interface {
+	writeMessage(msg WSMessage) error
+}
 
-	for {
-		select {
-		case msg := <-s.bufChan:
-			if msg.MsgType == FifteenSecWind {
-				ws.SetWriteDeadline(time.Now().Add(writeWait))
-				if err := ws.WriteJSON(msg); err != nil {
-					return
-				}
-			}
-		case <-pingTicker.C:
-			ws.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				return
-			}
-		}
-	}
+// wsSink sends messages to a WebSocket peer.
+type wsSink struct {
+	ws *websocket.Conn
+}
+
+func (s wsSink) writeMessage(msg WSMessage) error {
+	s.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.ws.WriteJSON(msg)
 }
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The most rows a client can ask to be backfilled with, per message type.
+const maxBackfillRows = 1000
+
+// ControlMsg is sent by a client of /api/ws to change what it receives. Actions are:
+//
+//	{"action": "subscribe", "types": ["TenMinute"]}          start receiving these message types
+//	{"action": "unsubscribe", "types": ["FifteenSecWind"]}   stop receiving them
+//	{"action": "fields", "fields": ["TempOutCur"]}           only send these TenMinute fields (none means all)
+//	{"action": "backfill", "count": 100}                     send the last 100 rows of each subscribed type
+//	{"action": "backfill", "since": "2016-06-01T12:00"}      send the rows recorded since then
+//
+// backfill takes an optional "types" list, which defaults to the subscribed types. Every control
+// message is answered with an Ack, echoing its optional "id".
+type ControlMsg struct {
+	ID     string    `json:"id,omitempty"`
+	Action string    `json:"action"`
+	Types  []MsgType `json:"types,omitempty"`
+	Fields []string  `json:"fields,omitempty"`
+	Count  int       `json:"count,omitempty"`
+	Since  string    `json:"since,omitempty"`
+}
+
+// ControlAck is the payload of an Ack message, the reply to a ControlMsg. Types lists the client's
+// subscriptions after the action was carried out, and Count the number of rows a backfill sent.
+type ControlAck struct {
+	ID     string    `json:"id,omitempty"`
+	Action string    `json:"action"`
+	OK     bool      `json:"ok"`
+	Error  string    `json:"error,omitempty"`
+	Types  []MsgType `json:"types"`
+	Fields []string  `json:"fields"`
+	Count  int       `json:"count,omitempty"`
+}
+
+// wsClient holds the subscription state of one WebSocket connection. It belongs to the connection's
+// writer goroutine; the reader only hands it raw control messages.
+type wsClient struct {
+	name    string
+	sub     *subscriber
+	types   map[MsgType]bool
+	fields  []string
+	units   UnitSystem
+	null    bool         // Replace readings that failed QC with null
+	fixed   bool         // The per-table feeds and event streams can't change their subscription
+	sent    streamCursor // Newest rows sent to the client
+	filled  uint64       // The subscriber's dropped count when fillGap last ran
+	control chan []byte  // Control messages, from the reader to the writer
+	hungUp  chan bool    // Closed when the reader exits
+	done    chan bool    // Closed when the writer exits
+}
+
+func newWSClient(name string, sub *subscriber, fixed bool, types ...MsgType) *wsClient {
+	c := &wsClient{
+		name:    name,
+		sub:     sub,
+		types:   make(map[MsgType]bool),
+		units:   Imperial,
+		fixed:   fixed,
+		control: make(chan []byte),
+		hungUp:  make(chan bool),
+		done:    make(chan bool),
+	}
+	for _, t := range types {
+		c.types[t] = true
+	}
+	return c
+}
+
+// prepare decides whether msg should be sent to the client, converts readings to the client's units,
+// adds derived values and QC flags, and trims them to the client's fields. Acks are always sent.
+func (c *wsClient) prepare(msg WSMessage) (WSMessage, bool) {
+	if msg.MsgType != Ack && !c.types[msg.MsgType] {
+		return msg, false
+	}
+
+	units := c.units.Units()
+	switch p := msg.Payload.(type) {
+	case TenMinAllRow:
+		row := tenMinOut(p, c.units)
+		row.Units = &units
+		msg.Payload = row.render(c.fields, c.null)
+	case FifteenSecWindMsg:
+		f := windOut(p, c.units)
+		f.Units = &units
+		msg.Payload = f.render(c.null)
+	case LocalForecast:
+		f := c.units.forecast(p)
+		f.Units = &units
+		msg.Payload = f
+	}
+	return msg, true
+}
+
+// send stamps msg with the client's position in the stream and writes it to out.
+// Messages of types the client isn't subscribed to are silently dropped.
+func (c *wsClient) send(out messageSink, msg WSMessage) error {
+	m, ok := c.prepare(msg)
+	if !ok {
+		return nil
+	}
+	c.sent.advance(msg)
+	m.ID = c.sent.String()
+	return out.writeMessage(m)
+}
+
+// subscribed lists the message types the client currently receives.
+func (c *wsClient) subscribed() []MsgType {
+	res := make([]MsgType, 0, len(c.types))
+	for _, t := range []MsgType{FifteenSecWind, TenMinute, Status, Forecast, Alert} {
+		if c.types[t] {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// handleControl carries out a control message and acknowledges it. Invalid messages get a failed
+// Ack; only an error writing to the connection is returned.
+func (a *ApiHandlers) handleControl(out messageSink, c *wsClient, data []byte) error {
+	cm := ControlMsg{}
+	ack := ControlAck{}
+	err := json.Unmarshal(data, &cm)
+	if err == nil {
+		ack.ID, ack.Action = cm.ID, cm.Action
+		err = a.applyControl(out, c, cm, &ack)
+	}
+	if err != nil {
+		if _, ok := err.(connError); ok {
+			return err
+		}
+		ack.Error = err.Error()
+	}
+
+	ack.OK = err == nil
+	ack.Types = c.subscribed()
+	ack.Fields = c.fields
+	if ack.Fields == nil {
+		ack.Fields = []string{}
+	}
+	return c.send(out, WSMessage{MsgType: Ack, Payload: ack})
+}
+
+// connError wraps a failure to write to the connection, as opposed to a problem with the request.
+type connError struct {
+	error
+}
+
+func (a *ApiHandlers) applyControl(out messageSink, c *wsClient, cm ControlMsg, ack *ControlAck) error {
+	switch cm.Action {
+	case "subscribe", "unsubscribe":
+		if len(cm.Types) == 0 {
+			return fmt.Errorf("%s needs a list of types", cm.Action)
+		}
+		if err := checkMsgTypes(cm.Types); err != nil {
+			return err
+		}
+		for _, t := range cm.Types {
+			c.types[t] = cm.Action == "subscribe"
+		}
+	case "fields":
+		fields, err := parseFieldsParam(strings.Join(cm.Fields, ","), TenMinAllRow{})
+		if err != nil {
+			return err
+		}
+		c.fields = fields
+	case "backfill":
+		n, err := a.backfillClient(out, c, cm)
+		ack.Count = n
+		return err
+	default:
+		return fmt.Errorf("unknown action %q", cm.Action)
+	}
+	return nil
+}
+
+// checkMsgTypes makes sure every type is one a client can subscribe to.
+func checkMsgTypes(types []MsgType) error {
+	for _, t := range types {
+		switch t {
+		case FifteenSecWind, TenMinute, Status, Forecast, Alert:
+		default:
+			return fmt.Errorf("unknown message type %q", t)
+		}
+	}
+	return nil
+}
+
+// backfillClient sends the rows a backfill control message asks for straight to the connection,
+// oldest first, and returns how many were sent. If more than maxBackfillRows of a table were recorded
+// since the time asked for, the newest ones are sent, and the Ack says so.
+func (a *ApiHandlers) backfillClient(out messageSink, c *wsClient, cm ControlMsg) (int, error) {
+	if cm.Count < 0 {
+		return 0, fmt.Errorf("backfill count can't be negative")
+	}
+	if (cm.Count > 0) == (cm.Since != "") {
+		return 0, fmt.Errorf("backfill needs either a count or a since time")
+	}
+	if cm.Count > maxBackfillRows {
+		return 0, fmt.Errorf("backfill count can be at most %d", maxBackfillRows)
+	}
+	var q RangeQuery
+	if cm.Since != "" {
+		since, err := parseTimeParam(cm.Since, a.loc)
+		if err != nil {
+			return 0, fmt.Errorf("invalid since: %s", err)
+		}
+		q = RangeQuery{From: since, Limit: maxBackfillRows + 1}
+	}
+
+	types := cm.Types
+	if len(types) == 0 {
+		types = c.subscribed()
+	}
+	if err := checkMsgTypes(types); err != nil {
+		return 0, err
+	}
+
+	msgs := make([]WSMessage, 0)
+	truncated := false
+	for _, t := range types {
+		if !c.types[t] {
+			return 0, fmt.Errorf("can't backfill %s without subscribing to it", t)
+		}
+		switch t {
+		case FifteenSecWind:
+			var rows []FifteenSecWindMsg
+			var err error
+			if cm.Since == "" {
+				rows, err = a.store.RecentWind(cm.Count)
+			} else {
+				rows, err = a.store.WindRange(q)
+				if err == nil && len(rows) > maxBackfillRows {
+					truncated = true
+					rows, err = a.store.RecentWind(maxBackfillRows)
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("database query failed")
+			}
+			for _, f := range a.qcWind(rows) {
+				msgs = append(msgs, WSMessage{MsgType: FifteenSecWind, Payload: f})
+			}
+		case TenMinute:
+			var rows []TenMinAllRow
+			var err error
+			if cm.Since == "" {
+				rows, err = a.store.RecentTenMin(cm.Count)
+			} else {
+				rows, err = a.store.TenMinRange(q)
+				if err == nil && len(rows) > maxBackfillRows {
+					truncated = true
+					rows, err = a.store.RecentTenMin(maxBackfillRows)
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("database query failed")
+			}
+			for _, t := range a.qcTenMin(rows) {
+				msgs = append(msgs, WSMessage{MsgType: TenMinute, Payload: t})
+			}
+		}
+	}
+
+	for _, msg := range msgs {
+		if err := c.send(out, msg); err != nil {
+			return 0, connError{err}
+		}
+	}
+	if truncated {
+		return len(msgs), fmt.Errorf("too far back, only the newest %d rows of each table were sent", maxBackfillRows)
+	}
+	return len(msgs), nil
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+// collectSink keeps the messages written to it.
+type collectSink struct {
+	msgs []WSMessage
+}
+
+func (s *collectSink) writeMessage(msg WSMessage) error {
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+func TestBackfillBadCount(t *testing.T) {
+	s := NewMemoryStore()
+	a := NewApiHandlers(s, time.UTC)
+	for i := 0; i < 3; i++ {
+		s.InsertWind(&FifteenSecWindMsg{DateTime: time.Now(), WindDirCur: 180, WindDirCurEng: "S", WindSpeedCur: 5})
+	}
+	c := newWSClient("test", nil, false, FifteenSecWind, TenMinute)
+
+	for _, data := range []string{
+		`{"action":"backfill","count":-5}`,
+		`{"action":"backfill","count":-5,"since":"2024-01-01"}`,
+		`{"action":"backfill","count":1001}`,
+		`{"action":"backfill","count":5,"since":"2024-01-01"}`,
+		`{"action":"backfill"}`,
+	} {
+		out := &collectSink{}
+		if err := a.handleControl(out, c, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if len(out.msgs) != 1 {
+			t.Fatalf("%s: expected only an Ack, got %+v", data, out.msgs)
+		}
+		if ack := out.msgs[0].Payload.(ControlAck); ack.OK || ack.Error == "" {
+			t.Errorf("%s: expected a failed Ack, got %+v", data, ack)
+		}
+	}
+
+	out := &collectSink{}
+	if err := a.handleControl(out, c, []byte(`{"action":"backfill","count":5}`)); err != nil {
+		t.Fatal(err)
+	}
+	if ack := out.msgs[len(out.msgs)-1].Payload.(ControlAck); !ack.OK || ack.Count != 3 {
+		t.Errorf("expected 3 rows to be sent, got %+v", ack)
+	}
+}
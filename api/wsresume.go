@@ -0,0 +1,203 @@
+package api
+
+import (
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Default number of rows of each table sent to a new WebSocket client, so charts can be filled in
+	// immediately. See SetBackfillSize.
+	defaultBackfillSize = 50
+
+	// The most rows of each table replayed to a resuming client. A client that has missed more than
+	// this is sent the newest rows instead, and told that some were skipped.
+	maxReplayRows = 10000
+)
+
+// streamCursor marks a WebSocket client's position in the stream: the ID of the newest row of each
+// table it has been sent. It's sent as the "id" of every message, in the form "<10min ID>-<15sec ID>",
+// and a client that reconnects with ?since=<id> is sent exactly the rows it missed.
+type streamCursor struct {
+	TenMinID int
+	WindID   int
+}
+
+func (sc streamCursor) String() string {
+	return fmt.Sprintf("%d-%d", sc.TenMinID, sc.WindID)
+}
+
+// parseStreamCursor parses the since parameter of a WebSocket request. It returns nil if s is empty.
+func parseStreamCursor(s string) (*streamCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid since parameter %q, expected an id of the form <10min ID>-<15sec ID>", s)
+	}
+	ten, err1 := strconv.Atoi(parts[0])
+	wind, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || ten < 0 || wind < 0 {
+		return nil, fmt.Errorf("invalid since parameter %q, expected an id of the form <10min ID>-<15sec ID>", s)
+	}
+	return &streamCursor{TenMinID: ten, WindID: wind}, nil
+}
+
+// advance moves the cursor past the row in msg, if it's a stored one.
+func (sc *streamCursor) advance(msg WSMessage) {
+	switch p := msg.Payload.(type) {
+	case FifteenSecWindMsg:
+		if p.ID > sc.WindID {
+			sc.WindID = p.ID
+		}
+	case TenMinAllRow:
+		if p.ID > sc.TenMinID {
+			sc.TenMinID = p.ID
+		}
+	}
+}
+
+// covers reports whether the row in msg is at or before the cursor, i.e. has already been sent.
+// Readings that were ingested but couldn't be stored have no ID, and are never considered sent.
+func (sc streamCursor) covers(msg WSMessage) bool {
+	switch p := msg.Payload.(type) {
+	case FifteenSecWindMsg:
+		return p.ID > 0 && p.ID <= sc.WindID
+	case TenMinAllRow:
+		return p.ID > 0 && p.ID <= sc.TenMinID
+	}
+	return false
+}
+
+// catchUp sends a newly connected client the rows it needs before live readings: the rows after
+// since if it's resuming, or else the most recent few of each table. The client has already been
+// subscribed, so anything that arrives meanwhile waits in its buffer, and is skipped if it was part
+// of the catch up.
+func (a *ApiHandlers) catchUp(out messageSink, c *wsClient, since *streamCursor) error {
+	if since != nil {
+		c.sent = *since
+	}
+
+	skipped := false
+	sent := 0
+	backfill := a.getBackfillSize()
+	if c.types[FifteenSecWind] {
+		var rows []FifteenSecWindMsg
+		var err error
+		if since == nil {
+			rows, err = a.store.RecentWind(backfill)
+		} else {
+			rows, err = a.store.WindRange(RangeQuery{AfterID: since.WindID, Limit: maxReplayRows + 1})
+			if err == nil && len(rows) > maxReplayRows {
+				skipped = true
+				rows, err = a.store.RecentWind(maxReplayRows)
+			}
+		}
+		if err != nil {
+			jww.ERROR.Println(err)
+		}
+		for _, f := range a.qcWind(rows) {
+			if err := c.send(out, WSMessage{MsgType: FifteenSecWind, Payload: f}); err != nil {
+				return err
+			}
+		}
+		sent += len(rows)
+	}
+
+	if c.types[TenMinute] {
+		var rows []TenMinAllRow
+		var err error
+		if since == nil {
+			rows, err = a.store.RecentTenMin(backfill)
+		} else {
+			rows, err = a.store.TenMinRange(RangeQuery{AfterID: since.TenMinID, Limit: maxReplayRows + 1})
+			if err == nil && len(rows) > maxReplayRows {
+				skipped = true
+				rows, err = a.store.RecentTenMin(maxReplayRows)
+			}
+		}
+		if err != nil {
+			jww.ERROR.Println(err)
+		}
+		for _, t := range a.qcTenMin(rows) {
+			if err := c.send(out, WSMessage{MsgType: TenMinute, Payload: t}); err != nil {
+				return err
+			}
+		}
+		sent += len(rows)
+	}
+
+	// Let the new client know straight away if what it was just sent is stale, what the outlook is, and
+	// which alerts are firing.
+	a.monitor.RLock()
+	st, f := a.monitor.status, a.monitor.forecast
+	a.monitor.RUnlock()
+	if !st.Online && c.types[Status] {
+		if err := c.send(out, WSMessage{MsgType: Status, Payload: st}); err != nil {
+			return err
+		}
+	}
+	if f != nil && c.types[Forecast] {
+		if err := c.send(out, WSMessage{MsgType: Forecast, Payload: *f}); err != nil {
+			return err
+		}
+	}
+	if c.types[Alert] {
+		for _, ev := range a.alerts.active() {
+			if err := c.send(out, WSMessage{MsgType: Alert, Payload: ev}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The per-table feeds only carry readings, so only the combined feed is told how the resume went.
+	if since != nil && !c.fixed {
+		ack := ControlAck{Action: "resume", OK: !skipped, Count: sent, Types: c.subscribed(), Fields: []string{}}
+		if skipped {
+			ack.Error = fmt.Sprintf("too far behind, only the newest %d rows of each table were replayed", maxReplayRows)
+		}
+		return c.send(out, WSMessage{MsgType: Ack, Payload: ack})
+	}
+	return nil
+}
+
+// fillGap sends a DropOldest client the rows its buffer has discarded since it last ran, read back from
+// storage, so the rows it's sent (and the since= it can resume from) have no gaps. Status, Forecast and
+// Alert messages aren't stored, and aren't recovered. The writer calls it before each live message,
+// which is skipped afterwards if it was among the rows sent.
+func (a *ApiHandlers) fillGap(out messageSink, c *wsClient) error {
+	dropped := atomic.LoadUint64(&c.sub.dropped)
+	if c.sub.policy != DropOldest || dropped == c.filled {
+		return nil
+	}
+	c.filled = dropped
+
+	// A table the client hasn't been sent any rows of has no gap to fill.
+	if c.types[FifteenSecWind] && c.sent.WindID > 0 {
+		rows, err := a.store.WindRange(RangeQuery{AfterID: c.sent.WindID, Limit: maxReplayRows})
+		if err != nil {
+			jww.ERROR.Println(err)
+		}
+		for _, f := range a.qcWind(rows) {
+			if err := c.send(out, WSMessage{MsgType: FifteenSecWind, Payload: f}); err != nil {
+				return err
+			}
+		}
+	}
+	if c.types[TenMinute] && c.sent.TenMinID > 0 {
+		rows, err := a.store.TenMinRange(RangeQuery{AfterID: c.sent.TenMinID, Limit: maxReplayRows})
+		if err != nil {
+			jww.ERROR.Println(err)
+		}
+		for _, t := range a.qcTenMin(rows) {
+			if err := c.send(out, WSMessage{MsgType: TenMinute, Payload: t}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
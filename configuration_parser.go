@@ -1,36 +1,545 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	jww "github.com/spf13/jwalterweatherman"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valleycamp/weathermoss/api"
 )
 
 type Configuration struct {
-	DB DBSettings `json:"database"`
+	Server      ServerSettings      `json:"server"`
+	Logging     LoggingSettings     `json:"logging"`
+	DB          DBSettings          `json:"database"`
+	Station     StationSettings     `json:"station"`
+	Monitor     MonitorSettings     `json:"monitor"`
+	Meteobridge MeteobridgeSettings `json:"meteobridge"`
+	Ingest      IngestSettings      `json:"ingest"`
+	WebSocket   WebSocketSettings   `json:"websocket"`
+	Alerts      AlertSettings       `json:"alerts"`
+}
+
+type ServerSettings struct {
+	// The port to run the HTTP server on. Defaults to 8777 ("WM"); the -port flag takes precedence.
+	Port int `json:"port"`
+	// How long to wait for clients and the database when shutting down. Defaults to 10s.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Origins of other sites' pages allowed to use the API, e.g. "https://dashboard.example.com", or
+	// "*" for any.
+	CORSOrigins []string `json:"cors_origins"`
+}
+
+type LoggingSettings struct {
+	// Where to write the log. Defaults to weathermoss.log.
+	File string `json:"file"`
+	// Least severe messages written to the log file and to STDOUT: one of trace, debug, info, warn,
+	// error, critical or fatal. Default to warn and error; the -verbose flag sets debug and info.
+	Level       string `json:"level"`
+	StdoutLevel string `json:"stdout_level"`
+}
+
+// MonitorSettings tune how the database is watched for new readings.
+type MonitorSettings struct {
+	// How often to check whether a table is due to be polled. Defaults to 1s.
+	PollPeriod Duration `json:"poll_period"`
+	// Rows of each table sent to a WebSocket client when it connects. Defaults to 50.
+	BackfillSize int `json:"backfill_size"`
 }
 
 type DBSettings struct {
+	// Which storage backend to use: "mysql" (the default), "sqlite" or "memory".
+	Driver string `json:"driver"`
+	// Path to the database file, for the sqlite driver.
+	Path string `json:"path"`
+
 	Host     string `json:"host"`
 	Port     string `json:"port"`
 	Username string `json:"username"`
 	Password string `json:"password"`
-	Database string `json:"database"`
+	// File to read the password from instead, e.g. a Docker or systemd secret. The password can also be
+	// given in WEATHERMOSS_DATABASE_PASSWORD.
+	PasswordFile string `json:"password_file"`
+	Database     string `json:"database"`
+
+	// Connection options for MySQL. tls is "true", "false" (the default), "skip-verify" or "preferred";
+	// tls_ca_file verifies the server against a CA certificate instead. loc is the timezone DateTime
+	// values are read in, and defaults to the station's timezone.
+	TLS          string   `json:"tls"`
+	TLSCAFile    string   `json:"tls_ca_file"`
+	Timeout      Duration `json:"timeout"`
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+	Charset      string   `json:"charset"`
+	Loc          string   `json:"loc"`
+}
+
+// Name of the TLS configuration registered with the MySQL driver for tls_ca_file.
+const mysqlTLSConfigName = "weathermoss"
+
+// MySQLConfig builds the MySQL driver's configuration. DateTime values are read in loc, unless the
+// settings name another timezone.
+func (s DBSettings) MySQLConfig(loc *time.Location) (*mysql.Config, error) {
+	c := mysql.NewConfig()
+	c.User = s.Username
+	c.Passwd = s.Password
+	c.Net = "tcp"
+	c.Addr = net.JoinHostPort(stringOr(s.Host, "127.0.0.1"), stringOr(s.Port, "3306"))
+	c.DBName = s.Database
+	c.ParseTime = true
+	c.Timeout = s.Timeout.Duration
+	c.ReadTimeout = s.ReadTimeout.Duration
+	c.WriteTimeout = s.WriteTimeout.Duration
+
+	c.Loc = loc
+	if s.Loc != "" {
+		l, err := time.LoadLocation(s.Loc)
+		if err != nil {
+			return nil, err
+		}
+		c.Loc = l
+	}
+
+	if s.Charset != "" {
+		c.Params = map[string]string{"charset": s.Charset}
+	}
+
+	c.TLSConfig = s.TLS
+	if s.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(s.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", s.TLSCAFile)
+		}
+		if err := mysql.RegisterTLSConfig(mysqlTLSConfigName, &tls.Config{RootCAs: pool}); err != nil {
+			return nil, err
+		}
+		c.TLSConfig = mysqlTLSConfigName
+	}
+
+	return c, nil
+}
+
+// stringOr returns s, or def if s is empty.
+func stringOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// redactedDSN formats c for logging, without the password.
+func redactedDSN(c *mysql.Config) string {
+	r := *c
+	if r.Passwd != "" {
+		r.Passwd = "xxxxx"
+	}
+	return r.FormatDSN()
+}
+
+// redactedURL returns u with any password in it replaced, for logging.
+func redactedURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Redacted()
+}
+
+type StationSettings struct {
+	// IANA timezone name (e.g. "America/Los_Angeles") the Meteobridge records its DateTime values in.
+	// Defaults to the server's local timezone.
+	Timezone string `json:"timezone"`
+}
+
+// Location loads the station's timezone.
+func (s StationSettings) Location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+// MeteobridgeSettings configure collecting live data directly from the Meteobridge. Leave URL empty
+// to rely on the Meteobridge logging into the database instead.
+type MeteobridgeSettings struct {
+	URL          string   `json:"url"`
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	TenMinPeriod Duration `json:"ten_min_period"`
+	WindPeriod   Duration `json:"wind_period"`
+	Timeout      Duration `json:"timeout"`
+}
+
+// IngestSettings configure the /api/ingest endpoints the Meteobridge can push readings to.
+type IngestSettings struct {
+	// Secrets that authorize a request to the ingest endpoints. Ingestion is disabled if there are none.
+	Tokens []string `json:"tokens"`
+}
+
+// WebSocketSettings configure the live WebSocket and event stream feeds.
+type WebSocketSettings struct {
+	// What to do when a client can't keep up: "drop-oldest" (the default), "coalesce" or "disconnect".
+	// Clients can choose for themselves with ?overflow=.
+	Overflow api.OverflowPolicy `json:"overflow"`
+	// Messages that can wait for a slow client before the overflow policy applies. Defaults to 110.
+	BufferSize int `json:"buffer_size"`
+}
+
+// AlertSettings configure alerts on the readings, which are listed at /api/alerts and sent to WebSocket
+// clients, and optionally to a webhook.
+type AlertSettings struct {
+	// URL each alert is POSTed to as JSON, when it fires and when it clears. Empty turns the webhook off.
+	WebhookURL string `json:"webhook_url"`
+	// How long to wait for the webhook. Defaults to 10s.
+	WebhookTimeout Duration            `json:"webhook_timeout"`
+	Rules          []AlertRuleSettings `json:"rules"`
+}
+
+// AlertRuleSettings define an alert, e.g. {"name": "Frost", "field": "TempOutCur", "op": "<", "value": 33,
+// "for": "30m"}. Values are in the units the readings are stored in: °F, mph, inHg and in.
+type AlertRuleSettings struct {
+	Name string `json:"name"`
+	// A column of housestation_10min_all, or of housestation_15sec_wind if table is "15sec".
+	Field string  `json:"field"`
+	Table string  `json:"table"`
+	Op    string  `json:"op"` // >, >=, < or <=
+	Value float64 `json:"value"`
+	// How long the condition must hold before the alert fires. Defaults to firing straight away.
+	For Duration `json:"for"`
+	// How far back past value a reading must go for the alert to clear.
+	Hysteresis float64 `json:"hysteresis"`
+	// The shortest time between two alerts of the rule.
+	Cooldown Duration `json:"cooldown"`
+}
+
+// alertRules converts the rules to the API's.
+func (s AlertSettings) alertRules() []api.AlertRule {
+	rules := make([]api.AlertRule, 0, len(s.Rules))
+	for _, r := range s.Rules {
+		rules = append(rules, api.AlertRule{
+			Name:       r.Name,
+			Field:      r.Field,
+			Table:      r.Table,
+			Op:         r.Op,
+			Value:      r.Value,
+			For:        r.For.Duration,
+			Hysteresis: r.Hysteresis,
+			Cooldown:   r.Cooldown.Duration,
+		})
+	}
+	return rules
+}
+
+// Duration is a time.Duration written in the config file as a string, e.g. "15s" or "10m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"15s\" or \"10m\", got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// defaultConfiguration is the configuration used for anything the config file leaves out.
+func defaultConfiguration() Configuration {
+	return Configuration{
+		Server: ServerSettings{
+			Port:            8777, // 8777 = "WM"
+			ShutdownTimeout: Duration{10 * time.Second},
+		},
+		Logging: LoggingSettings{
+			File:        "weathermoss.log",
+			Level:       "warn",
+			StdoutLevel: "error",
+		},
+		Monitor: MonitorSettings{
+			PollPeriod:   Duration{1 * time.Second},
+			BackfillSize: 50,
+		},
+		Meteobridge: MeteobridgeSettings{
+			TenMinPeriod: Duration{10 * time.Minute},
+			WindPeriod:   Duration{15 * time.Second},
+			Timeout:      Duration{10 * time.Second},
+		},
+		WebSocket: WebSocketSettings{
+			Overflow:   api.DropOldest,
+			BufferSize: 110,
+		},
+		Alerts: AlertSettings{
+			WebhookTimeout: Duration{10 * time.Second},
+		},
+	}
 }
 
 // getConfigFromFile does what it says on the box and returns a Configuration object
-// representing the config file.
+// representing the config file. Settings can be overridden with environment variables, see applyEnv,
+// and the result is checked with validate.
 func getConfigFromFile(path string) (*Configuration, error) {
-	file, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	decoder := json.NewDecoder(file)
-	configuration := Configuration{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	configuration := defaultConfiguration()
 	err = decoder.Decode(&configuration)
 	if err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			return nil, fmt.Errorf("%s:%d: %s", path, bytes.Count(data[:se.Offset], []byte("\n"))+1, err)
+		}
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := configuration.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := configuration.readSecrets(); err != nil {
+		return nil, err
+	}
+	if err := configuration.validate(); err != nil {
 		return nil, err
 	}
 
 	return &configuration, nil
 }
+
+// Prefix of the environment variables that override the config file.
+const envPrefix = "WEATHERMOSS_"
+
+// applyEnv overrides settings with environment variables named after their section and key, e.g.
+// WEATHERMOSS_DATABASE_PASSWORD or WEATHERMOSS_SERVER_PORT. Lists are comma separated.
+func (c *Configuration) applyEnv() error {
+	cv := reflect.ValueOf(c).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		section := cv.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			name := envPrefix + strings.ToUpper(jsonName(cv.Type().Field(i))+"_"+jsonName(section.Type().Field(j)))
+			s, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setFromString(section.Field(j), s); err != nil {
+				return fmt.Errorf("environment variable %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readSecrets reads the settings that are kept in files of their own.
+func (c *Configuration) readSecrets() error {
+	if c.DB.PasswordFile == "" {
+		return nil
+	}
+	if c.DB.Password != "" {
+		return fmt.Errorf("invalid configuration: database.password and database.password_file can't both be set")
+	}
+	b, err := ioutil.ReadFile(c.DB.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: can't read database.password_file: %s", err)
+	}
+	c.DB.Password = strings.TrimRight(string(b), "\r\n")
+	return nil
+}
+
+// jsonName returns the name a struct field has in the config file.
+func jsonName(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("json"), ",")[0]
+}
+
+// setFromString sets a config setting from the text of an environment variable.
+func setFromString(v reflect.Value, s string) error {
+	if _, ok := v.Interface().(Duration); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(Duration{d}))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", s)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("this setting can only be set in the config file")
+		}
+		list := make([]string, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("this setting can only be set in the config file")
+	}
+	return nil
+}
+
+// The most rows of each table that can be backfilled, matching the limit on backfill control messages.
+const maxBackfillSize = 1000
+
+// logLevels maps the names used in the logging section to jww's thresholds.
+var logLevels = map[string]jww.Level{
+	"trace":    jww.LevelTrace,
+	"debug":    jww.LevelDebug,
+	"info":     jww.LevelInfo,
+	"warn":     jww.LevelWarn,
+	"error":    jww.LevelError,
+	"critical": jww.LevelCritical,
+	"fatal":    jww.LevelFatal,
+}
+
+// validate checks every setting, and reports all of the problems at once.
+func (c *Configuration) validate() error {
+	problems := make([]string, 0)
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		problem("server.port must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.ShutdownTimeout.Duration <= 0 {
+		problem("server.shutdown_timeout must be positive, got %s", c.Server.ShutdownTimeout)
+	}
+
+	for _, o := range c.Server.CORSOrigins {
+		if u, err := url.Parse(o); o != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			problem("server.cors_origins must contain \"*\" or origins like \"https://example.com\", got %q", o)
+		}
+	}
+
+	if c.Logging.File == "" {
+		problem("logging.file can't be empty")
+	}
+	if _, ok := logLevels[c.Logging.Level]; !ok {
+		problem("logging.level must be one of trace, debug, info, warn, error, critical or fatal, got %q", c.Logging.Level)
+	}
+	if _, ok := logLevels[c.Logging.StdoutLevel]; !ok {
+		problem("logging.stdout_level must be one of trace, debug, info, warn, error, critical or fatal, got %q", c.Logging.StdoutLevel)
+	}
+
+	switch c.DB.Driver {
+	case "", "mysql":
+		if c.DB.Database == "" {
+			problem("database.database must name the MySQL database to use")
+		}
+		switch c.DB.TLS {
+		case "", "true", "false", "skip-verify", "preferred":
+		default:
+			problem("database.tls must be true, false, skip-verify or preferred, got %q", c.DB.TLS)
+		}
+		if c.DB.Timeout.Duration < 0 || c.DB.ReadTimeout.Duration < 0 || c.DB.WriteTimeout.Duration < 0 {
+			problem("database.timeout, read_timeout and write_timeout can't be negative")
+		}
+		if _, err := time.LoadLocation(c.DB.Loc); c.DB.Loc != "" && err != nil {
+			problem("database.loc %q is not a known timezone: %s", c.DB.Loc, err)
+		}
+	case "sqlite":
+		if c.DB.Path == "" {
+			problem("database.path must be set for the sqlite driver")
+		}
+	case "memory":
+	default:
+		problem("database.driver must be mysql, sqlite or memory, got %q", c.DB.Driver)
+	}
+
+	if _, err := c.Station.Location(); err != nil {
+		problem("station.timezone %q is not a known timezone: %s", c.Station.Timezone, err)
+	}
+
+	if c.Monitor.PollPeriod.Duration < 100*time.Millisecond {
+		problem("monitor.poll_period must be at least 100ms, got %s", c.Monitor.PollPeriod)
+	}
+	if c.Monitor.BackfillSize < 0 || c.Monitor.BackfillSize > maxBackfillSize {
+		problem("monitor.backfill_size must be between 0 and %d, got %d", maxBackfillSize, c.Monitor.BackfillSize)
+	}
+
+	if c.Meteobridge.URL != "" {
+		if u, err := url.Parse(c.Meteobridge.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("meteobridge.url must be an http:// or https:// URL, got %q", redactedURL(c.Meteobridge.URL))
+		}
+	}
+	if c.Meteobridge.TenMinPeriod.Duration <= 0 || c.Meteobridge.WindPeriod.Duration <= 0 || c.Meteobridge.Timeout.Duration <= 0 {
+		problem("meteobridge.ten_min_period, wind_period and timeout must all be positive")
+	}
+
+	for _, t := range c.Ingest.Tokens {
+		if strings.TrimSpace(t) == "" {
+			// An empty token would let requests without one through.
+			problem("ingest.tokens can't contain an empty token")
+			break
+		}
+	}
+
+	if _, err := api.ParseOverflowPolicy(string(c.WebSocket.Overflow)); err != nil {
+		problem("websocket.overflow: %s", err)
+	}
+	if c.WebSocket.BufferSize < api.MinSubscriberBuffer {
+		problem("websocket.buffer_size must be at least %d, got %d", api.MinSubscriberBuffer, c.WebSocket.BufferSize)
+	}
+
+	if c.Alerts.WebhookURL != "" {
+		if u, err := url.Parse(c.Alerts.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("alerts.webhook_url must be an http:// or https:// URL, got %q", redactedURL(c.Alerts.WebhookURL))
+		}
+	}
+	if c.Alerts.WebhookTimeout.Duration <= 0 {
+		problem("alerts.webhook_timeout must be positive, got %s", c.Alerts.WebhookTimeout)
+	}
+	names := make(map[string]bool)
+	for _, r := range c.Alerts.alertRules() {
+		if err := r.Validate(); err != nil {
+			problem("alerts.rules: %s", err)
+		}
+		if names[r.Name] {
+			problem("alerts.rules: there's more than one rule called %q", r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Package meteobridge collects live readings straight from a Meteobridge, by having it fill in a
+// template with the same placeholders the README's SQL events use.
+package meteobridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/valleycamp/weathermoss/api"
+)
+
+// A Field of a template: the column it fills, and the Meteobridge placeholder that provides its value.
+type Field struct {
+	Column      string
+	Placeholder string
+}
+
+// TenMinFields mirror the every-10-minute SQL event in the README.
+var TenMinFields = []Field{
+	{"DateTime", "[YYYY]-[MM]-[DD] [hh]:[mm]:[ss]"},
+	{"TempOutCur", "[th0temp-act=F]"},
+	{"HumOutCur", "[th0hum-act]"},
+	{"PressCur", "[thb0seapress-act=inHg.2]"},
+	{"DewCur", "[th0dew-act=F]"},
+	{"HeatIdxCur", "[th0heatindex-act=F]"},
+	{"WindChillCur", "[wind0chill-act=F]"},
+	{"TempInCur", "[thb0temp-act=F]"},
+	{"HumInCur", "[thb0hum-act]"},
+	{"WindSpeedCur", "[wind0wind-act=mph]"},
+	{"WindAvgSpeedCur", "[wind0avgwind-act=mph]"},
+	{"WindDirCur", "[wind0dir-act]"},
+	{"WindDirCurEng", "[wind0dir-act=endir]"},
+	{"WindGust10", "[wind0wind-max10=mph]"},
+	{"WindDirAvg10", "[wind0dir-avg10]"},
+	{"WindDirAvg10Eng", "[wind0dir-avg10=endir]"},
+	{"UVAvg10", "[uv0index-avg10]"},
+	{"UVMax10", "[uv0index-max10]"},
+	{"SolarRadAvg10", "[sol0rad-avg10]"},
+	{"SolarRadMax10", "[sol0rad-max10]"},
+	{"RainRateCur", "[rain0rate-act=in.2]"},
+	{"RainDay", "[rain0total-daysum=in.2]"},
+	{"RainYest", "[rain0total-ydaysum=in.2]"},
+	{"RainMonth", "[rain0total-monthsum=in.2]"},
+	{"RainYear", "[rain0total-yearsum=in.2]"},
+}
+
+// WindFields mirror the every-15-seconds SQL event in the README.
+var WindFields = []Field{
+	{"DateTime", "[YYYY]-[MM]-[DD] [hh]:[mm]:[ss]"},
+	{"WindDirCur", "[wind0dir-act]"},
+	{"WindDirCurEng", "[wind0dir-act=endir]"},
+	{"WindSpeedCur", "[wind0wind-act=mph]"},
+}
+
+// Template returns a Meteobridge template that renders fields as a query string, e.g.
+// "DateTime=[YYYY]-...&TempOutCur=[th0temp-act=F]&...". The same format is accepted by the
+// /api/ingest endpoints, so it can also be used as the URL of a Meteobridge HTTP request event.
+func Template(fields []Field) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = f.Column + "=" + f.Placeholder
+	}
+	return strings.Join(parts, "&")
+}
+
+// Client fetches rendered templates from a Meteobridge.
+type Client struct {
+	// Base URL of the Meteobridge, e.g. "http://192.168.1.50".
+	URL string
+	// Credentials for the Meteobridge's web interface.
+	Username string
+	Password string
+	// Timezone the Meteobridge's clock is set to.
+	Location *time.Location
+
+	HTTP *http.Client
+}
+
+// FetchTenMin asks the Meteobridge for its current 10 minute readings.
+func (c *Client) FetchTenMin() (api.TenMinAllRow, error) {
+	v, err := c.render(Template(TenMinFields))
+	if err != nil {
+		return api.TenMinAllRow{}, err
+	}
+	return api.ParseTenMinAllRow(v, c.Location)
+}
+
+// FetchWind asks the Meteobridge for its current wind readings.
+func (c *Client) FetchWind() (api.FifteenSecWindMsg, error) {
+	v, err := c.render(Template(WindFields))
+	if err != nil {
+		return api.FifteenSecWindMsg{}, err
+	}
+	return api.ParseFifteenSecWind(v, c.Location)
+}
+
+// render has the Meteobridge's template.cgi fill in tmpl, and parses the result as a query string.
+func (c *Client) render(tmpl string) (url.Values, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(c.URL, "/")+"/cgi-bin/template.cgi?template="+url.QueryEscape(tmpl), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("meteobridge returned %s", resp.Status)
+	}
+
+	return url.ParseQuery(strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,130 @@
+package meteobridge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stationValues are what a Meteobridge renders each placeholder as.
+var stationValues = map[string]string{
+	"[YYYY]-[MM]-[DD] [hh]:[mm]:[ss]": "2016-06-01 10:20:00",
+	"[th0temp-act=F]":                 "68.4",
+	"[th0hum-act]":                    "55",
+	"[thb0seapress-act=inHg.2]":       "30.02",
+	"[th0dew-act=F]":                  "51.6",
+	"[th0heatindex-act=F]":            "68.4",
+	"[wind0chill-act=F]":              "68.4",
+	"[thb0temp-act=F]":                "71.2",
+	"[thb0hum-act]":                   "40",
+	"[wind0wind-act=mph]":             "5.4",
+	"[wind0avgwind-act=mph]":          "4.1",
+	"[wind0dir-act]":                  "270",
+	"[wind0dir-act=endir]":            "W",
+	"[wind0wind-max10=mph]":           "12.3",
+	"[wind0dir-avg10]":                "265",
+	"[wind0dir-avg10=endir]":          "W",
+	"[uv0index-avg10]":                "3.2",
+	"[uv0index-max10]":                "4.0",
+	"[sol0rad-avg10]":                 "512",
+	"[sol0rad-max10]":                 "640",
+	"[rain0rate-act=in.2]":            "0.00",
+	"[rain0total-daysum=in.2]":        "0.12",
+	"[rain0total-ydaysum=in.2]":       "0.50",
+	"[rain0total-monthsum=in.2]":      "1.37",
+	"[rain0total-yearsum=in.2]":       "14.08",
+}
+
+// newStation starts a stand-in for a Meteobridge's template.cgi, which fills in the placeholders of the
+// template it's given without escaping the results, as the real one does.
+func newStation(values map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cgi-bin/template.cgi" {
+			http.NotFound(w, r)
+			return
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "meteobridge" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Meteobridge"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		out := r.URL.Query().Get("template")
+		for placeholder, v := range values {
+			out = strings.Replace(out, placeholder, v, -1)
+		}
+		w.Write([]byte(out + "\r\n"))
+	}))
+}
+
+func TestFetchTenMin(t *testing.T) {
+	srv := newStation(stationValues)
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL + "/", Username: "meteobridge", Password: "secret", Location: time.UTC}
+	row, err := c.FetchTenMin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2016, 6, 1, 10, 20, 0, 0, time.UTC); !row.DateTime.Equal(want) {
+		t.Errorf("DateTime = %s, want %s", row.DateTime, want)
+	}
+	if row.TempOutCur != 68.4 || row.HumOutCur != 55 || row.PressCur != 30.02 || row.WindDirAvg10Eng != "W" || row.RainYear != 14.08 {
+		t.Errorf("unexpected row %+v", row)
+	}
+}
+
+func TestFetchWind(t *testing.T) {
+	srv := newStation(stationValues)
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, Username: "meteobridge", Password: "secret", Location: time.UTC}
+	f, err := c.FetchWind()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.DateTime.Minute() != 20 || f.WindDirCur != 270 || f.WindDirCurEng != "W" || f.WindSpeedCur != 5.4 {
+		t.Errorf("unexpected reading %+v", f)
+	}
+}
+
+func TestFetchUnauthorized(t *testing.T) {
+	srv := newStation(stationValues)
+	defer srv.Close()
+
+	c := &Client{URL: srv.URL, Username: "meteobridge", Password: "wrong", Location: time.UTC}
+	if _, err := c.FetchTenMin(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected a 401 error, got %v", err)
+	}
+}
+
+func TestFetchBadValues(t *testing.T) {
+	tests := []struct {
+		placeholder string
+		value       string
+		err         string
+	}{
+		// A sensor the Meteobridge doesn't have renders as nothing.
+		{"[uv0index-avg10]", "", "missing value for UVAvg10"},
+		{"[th0hum-act]", "--", `invalid HumOutCur "--"`},
+		{"[thb0seapress-act=inHg.2]", "n/a", `invalid PressCur "n/a"`},
+		{"[YYYY]-[MM]-[DD] [hh]:[mm]:[ss]", "2016-06-01", `invalid DateTime "2016-06-01"`},
+	}
+	for _, tt := range tests {
+		values := make(map[string]string, len(stationValues))
+		for k, v := range stationValues {
+			values[k] = v
+		}
+		values[tt.placeholder] = tt.value
+
+		srv := newStation(values)
+		c := &Client{URL: srv.URL, Username: "meteobridge", Password: "secret", Location: time.UTC}
+		_, err := c.FetchTenMin()
+		srv.Close()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s=%q: expected error %q, got %v", tt.placeholder, tt.value, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package meteobridge
+
+import (
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+
+	"github.com/valleycamp/weathermoss/api"
+)
+
+// Poller periodically fetches readings from a Meteobridge and hands them to a Sink.
+type Poller struct {
+	Client *Client
+	Sink   Sink
+
+	// How often to fetch each kind of reading; normally 10 minutes and 15 seconds, to match the tables.
+	TenMinPeriod time.Duration
+	WindPeriod   time.Duration
+}
+
+// Sink receives the readings a Poller collects. *api.ApiHandlers is a Sink.
+type Sink interface {
+	IngestTenMin(t api.TenMinAllRow) error
+	IngestWind(f api.FifteenSecWindMsg) error
+}
+
+// Run polls until done is closed. Failed fetches are logged and retried at the next tick.
+func (p *Poller) Run(done <-chan struct{}) {
+	tenMinTicker := time.NewTicker(p.TenMinPeriod)
+	windTicker := time.NewTicker(p.WindPeriod)
+	defer func() {
+		tenMinTicker.Stop()
+		windTicker.Stop()
+	}()
+
+	// Don't make anyone wait ten minutes for the first reading.
+	p.pollTenMin()
+	p.pollWind()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tenMinTicker.C:
+			p.pollTenMin()
+		case <-windTicker.C:
+			p.pollWind()
+		}
+	}
+}
+
+func (p *Poller) pollTenMin() {
+	t, err := p.Client.FetchTenMin()
+	if err != nil {
+		jww.ERROR.Println("Failed to fetch 10 minute readings from the Meteobridge:", err)
+		return
+	}
+	// Storage errors are logged by the sink, and the reading has still been published.
+	p.Sink.IngestTenMin(t)
+}
+
+func (p *Poller) pollWind() {
+	f, err := p.Client.FetchWind()
+	if err != nil {
+		jww.ERROR.Println("Failed to fetch wind readings from the Meteobridge:", err)
+		return
+	}
+	p.Sink.IngestWind(f)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/elazarl/go-bindata-assetfs"
@@ -9,12 +10,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
+	"time"
 
 	"database/sql"
-	_ "github.com/go-sql-driver/mysql"
 
 	"github.com/valleycamp/weathermoss/api"
+	"github.com/valleycamp/weathermoss/meteobridge"
 )
 
 // By default go generate is going to build the production version. Run the command with -debug flag for
@@ -23,7 +26,7 @@ import (
 
 func main() {
 	flgVerbose := flag.Bool("verbose", false, "Output additional debugging information to both STDOUT and the log file")
-	flgPortNum := flag.Int("port", 8777, "The port to run the HTTP server on.") // 8777 = "WM"
+	flgPortNum := flag.Int("port", 8777, "The port to run the HTTP server on. Overrides server.port in the config file.") // 8777 = "WM"
 	flgConfigPath := flag.String("conf", "weathermoss-conf.json", "Path to the config JSON file")
 	flgVersion := flag.Bool("version", false, "Show version information and quit.")
 	flag.Parse()
@@ -33,55 +36,41 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Note at this point only WARN or above is actually logged to file, and ERROR or above to console.
-	jww.SetLogFile("weathermoss.log")
-
-	// Set extra logging if the command line flag was set
-	if *flgVerbose {
-		jww.SetLogThreshold(jww.LevelDebug)
-		jww.SetStdoutThreshold(jww.LevelInfo)
-		jww.INFO.Println("Verbose debug level set.")
-	} else {
-		// Set custom default logging verbosity.
-		jww.SetLogThreshold(jww.LevelWarn)
-		jww.SetStdoutThreshold(jww.LevelError)
-	}
-
 	// Read config file
-	appconf, err := getConfigFromFile(*flgConfigPath)
+	appconf, err := loadConfig(*flgConfigPath, *flgPortNum)
 	if err != nil {
 		jww.FATAL.Println("Configuration Error:", err)
 		os.Exit(1)
 	}
 
-	// Set up something to handle ctrl-c/kill cleanup!
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, syscall.SIGTERM)
-	go func() {
-		<-c
-		fmt.Println("")
-		// TODO: Graceful cleanup http's listenAndServe runner?
-		// TODO: Any other cleanup needed?
-		fmt.Println("Cleaned up and shut down.")
-		os.Exit(0)
-	}()
+	jww.SetLogFile(appconf.Logging.File)
+	setLogThresholds(appconf.Logging, *flgVerbose)
 
-	jww.DEBUG.Println(fmt.Sprintf("Connecting to db: %s:%s@tcp(%s:%s)/%s?parseTime=true", appconf.DB.Username, appconf.DB.Password, appconf.DB.Host, appconf.DB.Port, appconf.DB.Database))
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", appconf.DB.Username, appconf.DB.Password, appconf.DB.Host, appconf.DB.Port, appconf.DB.Database))
+	stationLoc, err := appconf.Station.Location()
 	if err != nil {
-		jww.FATAL.Println("Failed to open database. Error was:", err)
+		jww.FATAL.Println("Configuration Error: invalid station timezone:", err)
 		os.Exit(1)
 	}
 
-	if err := db.Ping(); err != nil {
+	store, err := openStore(appconf.DB, stationLoc)
+	if err != nil {
 		jww.FATAL.Println("Failed to open database. Error was:", err)
 		os.Exit(1)
 	}
 
-	// Somewhat arbitrary. TODO: Tune as necessary.
-	db.SetMaxIdleConns(500)
-	db.SetMaxOpenConns(1000)
+	// "weathermoss migrate" creates or upgrades the tables, and then quits.
+	if flag.Arg(0) == "migrate" {
+		runMigrations(store)
+		return
+	}
+
+	// Refuse to start against tables that don't look like the ones we know how to read.
+	if v, ok := store.(api.SchemaValidator); ok {
+		if err := v.ValidateSchema(); err != nil {
+			jww.FATAL.Println(err)
+			os.Exit(1)
+		}
+	}
 
 	// Set up the HTTP router, followed by all the routes
 	router := bone.New()
@@ -97,13 +86,243 @@ func main() {
 	})
 
 	// Define the API (JSON) routes
-	api := api.NewApiHandlers(db)
+	api := api.NewApiHandlers(store, stationLoc)
+	applySettings(appconf, api)
+
+	// Optionally collect live data straight from the Meteobridge, instead of waiting for it to appear in the database.
+	stopPoller := make(chan struct{})
+	if appconf.Meteobridge.URL != "" {
+		startMeteobridgePoller(appconf.Meteobridge, stationLoc, api, stopPoller)
+	}
+
 	router.GetFunc("/api/current", api.Current)
+	router.GetFunc("/api/history/10min", api.TenMinHistory)
+	router.GetFunc("/api/history/15sec", api.FifteenSecHistory)
+	router.GetFunc("/api/aggregate", api.Aggregate)
+	router.GetFunc("/api/forecast/local", api.LocalForecastHandler)
+	router.GetFunc("/api/alerts", api.Alerts)
+	// Meteobridge HTTP request events can only send GETs, so the ingest endpoints accept those too.
+	router.PostFunc("/api/ingest/10min", api.IngestTenMinHandler)
+	router.GetFunc("/api/ingest/10min", api.IngestTenMinHandler)
+	router.PostFunc("/api/ingest/15sec", api.IngestWindHandler)
+	router.GetFunc("/api/ingest/15sec", api.IngestWindHandler)
 	router.GetFunc("/api/ws", api.WsCombinedHandler)
 	router.GetFunc("/api/ws/10min", api.WsTenMinuteHandler)
 	router.GetFunc("/api/ws/15sec", api.WsFifteenSecHandler)
+	router.GetFunc("/api/subscribers", api.Subscribers)
+	router.GetFunc("/api/sse", api.SseCombinedHandler)
+	router.GetFunc("/api/sse/10min", api.SseTenMinuteHandler)
+	router.GetFunc("/api/sse/15sec", api.SseFifteenSecHandler)
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", appconf.Server.Port), Handler: api.CORS(router)}
+
+	// Set up something to handle ctrl-c/kill cleanup! Shutting down gracefully lets clients reconnect
+	// cleanly during deploys. SIGHUP reloads the config file.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGHUP)
+	stopped := make(chan struct{})
+	go func() {
+		running := appconf
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				running = reloadConfig(*flgConfigPath, *flgPortNum, *flgVerbose, appconf, running, api)
+				continue
+			}
+
+			fmt.Println("")
+			close(stopPoller)
+			shutdown(srv, api, store, running.Server.ShutdownTimeout.Duration)
+			close(stopped)
+			return
+		}
+	}()
 
 	// Start the HTTP server
-	fmt.Println("Starting API server on port", *flgPortNum, ". Press Ctrl-C to quit.")
-	http.ListenAndServe(fmt.Sprintf(":%d", *flgPortNum), router)
+	fmt.Println("Starting API server on port", appconf.Server.Port, ". Press Ctrl-C to quit.")
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		jww.FATAL.Println("HTTP server failed:", err)
+		os.Exit(1)
+	}
+	<-stopped
+	fmt.Println("Cleaned up and shut down.")
+}
+
+// loadConfig reads the config file, and applies the command line flags that take precedence over it.
+func loadConfig(path string, port int) (*Configuration, error) {
+	conf, err := getConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "port" {
+			conf.Server.Port = port
+		}
+	})
+	return conf, nil
+}
+
+// applySettings hands the API the settings that can be changed while it's running.
+func applySettings(conf *Configuration, a *api.ApiHandlers) {
+	a.SetIngestTokens(conf.Ingest.Tokens)
+	a.SetCORSOrigins(conf.Server.CORSOrigins)
+	a.SetPollPeriod(conf.Monitor.PollPeriod.Duration)
+	a.SetBackfillSize(conf.Monitor.BackfillSize)
+	a.SetSubscriberBuffer(conf.WebSocket.BufferSize)
+	a.SetOverflowPolicy(conf.WebSocket.Overflow)
+	a.SetAlertWebhook(conf.Alerts.WebhookURL, conf.Alerts.WebhookTimeout.Duration)
+	a.SetAlertRules(conf.Alerts.alertRules())
+}
+
+// reloadConfig re-reads the config file and applies what it can without a restart: log thresholds and
+// the API's settings, see applySettings. Connected clients are unaffected. Changes to anything else are
+// logged as needing a restart, compared to startup, the configuration WeatherMoss started with. If the
+// file is invalid nothing changes. It returns the configuration now in effect.
+func reloadConfig(path string, port int, verbose bool, startup, running *Configuration, a *api.ApiHandlers) *Configuration {
+	conf, err := loadConfig(path, port)
+	if err != nil {
+		jww.ERROR.Println("Not reloading the configuration:", err)
+		return running
+	}
+
+	setLogThresholds(conf.Logging, verbose)
+	applySettings(conf, a)
+
+	restart := []struct {
+		name    string
+		changed bool
+	}{
+		{"server.port", conf.Server.Port != startup.Server.Port},
+		{"logging.file", conf.Logging.File != startup.Logging.File},
+		{"database", !reflect.DeepEqual(conf.DB, startup.DB)},
+		{"station.timezone", conf.Station.Timezone != startup.Station.Timezone},
+		{"meteobridge", !reflect.DeepEqual(conf.Meteobridge, startup.Meteobridge)},
+	}
+	for _, r := range restart {
+		if r.changed {
+			jww.WARN.Println("The", r.name, "setting has changed, but only takes effect when WeatherMoss is restarted.")
+		}
+	}
+	jww.WARN.Println("Reloaded the configuration from", path)
+	return conf
+}
+
+// shutdown stops the server, giving everything timeout to finish. Streaming clients are told to go away
+// first, since the HTTP server waits for event streams to end and doesn't track WebSockets at all.
+// Requests in progress are allowed to finish before the database is closed.
+func shutdown(srv *http.Server, a *api.ApiHandlers, store api.Store, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Shutdown stops accepting connections straight away, then waits for the requests in progress.
+	srvDone := make(chan error, 1)
+	go func() {
+		srvDone <- srv.Shutdown(ctx)
+	}()
+	if err := a.Shutdown(ctx); err != nil {
+		jww.ERROR.Println("Timed out closing live feeds:", err)
+	}
+	if err := <-srvDone; err != nil {
+		jww.ERROR.Println("Timed out waiting for requests to finish:", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- store.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			jww.ERROR.Println("Failed to close the database:", err)
+		}
+	case <-ctx.Done():
+		jww.ERROR.Println("Timed out closing the database.")
+	}
+}
+
+// openStore opens the storage backend selected in the database section of the config file.
+func openStore(conf DBSettings, loc *time.Location) (api.Store, error) {
+	switch conf.Driver {
+	case "", "mysql":
+		// The Meteobridge writes DateTime in the station's local time, so have the driver read it back that way.
+		mc, err := conf.MySQLConfig(loc)
+		if err != nil {
+			return nil, err
+		}
+		jww.DEBUG.Println("Connecting to db:", redactedDSN(mc))
+		db, err := sql.Open("mysql", mc.FormatDSN())
+		if err != nil {
+			return nil, err
+		}
+
+		if err := db.Ping(); err != nil {
+			return nil, err
+		}
+
+		// Somewhat arbitrary. TODO: Tune as necessary.
+		db.SetMaxIdleConns(500)
+		db.SetMaxOpenConns(1000)
+
+		return api.NewMySQLStore(db), nil
+	case "sqlite":
+		jww.DEBUG.Println("Opening SQLite database:", conf.Path)
+		return api.NewSQLiteStore(conf.Path)
+	case "memory":
+		jww.WARN.Println("Using the in-memory store. Nothing will be persisted.")
+		return api.NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, expected mysql, sqlite or memory", conf.Driver)
+	}
+}
+
+// runMigrations applies any outstanding schema migrations to store, reporting what it did on STDOUT.
+func runMigrations(store api.Store) {
+	m, ok := store.(api.Migrator)
+	if !ok {
+		fmt.Println("This database driver doesn't need migrations.")
+		return
+	}
+
+	applied, err := m.Migrate()
+	for _, a := range applied {
+		fmt.Println("Applied migration", a)
+	}
+	if err != nil {
+		jww.FATAL.Println(err)
+		os.Exit(1)
+	}
+	if len(applied) == 0 {
+		fmt.Println("Database schema is already up to date.")
+	}
+}
+
+// startMeteobridgePoller starts fetching readings from the Meteobridge in the background.
+func startMeteobridgePoller(conf MeteobridgeSettings, loc *time.Location, sink meteobridge.Sink, done <-chan struct{}) {
+	p := &meteobridge.Poller{
+		Client: &meteobridge.Client{
+			URL:      conf.URL,
+			Username: conf.Username,
+			Password: conf.Password,
+			Location: loc,
+			HTTP:     &http.Client{Timeout: conf.Timeout.Duration},
+		},
+		Sink:         sink,
+		TenMinPeriod: conf.TenMinPeriod.Duration,
+		WindPeriod:   conf.WindPeriod.Duration,
+	}
+	jww.INFO.Println("Collecting live data from the Meteobridge at", redactedURL(conf.URL))
+	go p.Run(done)
+}
+
+// setLogThresholds applies the logging section of the config file, or the -verbose flag if it was set.
+func setLogThresholds(conf LoggingSettings, verbose bool) {
+	if verbose {
+		jww.SetLogThreshold(jww.LevelDebug)
+		jww.SetStdoutThreshold(jww.LevelInfo)
+		jww.INFO.Println("Verbose debug level set.")
+		return
+	}
+	jww.SetLogThreshold(logLevels[conf.Level])
+	jww.SetStdoutThreshold(logLevels[conf.StdoutLevel])
 }